@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// CKMSSummary is a quantile summary with rank error depending on the rank,
+// which is described in "Effective Computation of Biased Quantiles over
+// Data Streams" by Graham Cormode, Flip Korn, S. Muthukrishnan and Divesh
+// Srivastava. It uses the same tuples as Summary, but the allowed
+// gap+delta of a tuple is given by an invariant function of its rank
+// instead of the uniform 2*epsilon*n.
+//
+// A summary created with NewCKMSSummary is accurate at the targeted
+// quantiles and a summary created with NewBiasedCKMSSummary is accurate
+// relative to the rank, or to the distance from the maximum rank.
+type CKMSSummary struct {
+	tuples []tuple
+	n      int // number of values in tuples
+
+	// values not merged into tuples yet
+	buffer []float64
+
+	targets []CKMSTarget // nil for biased summaries
+	epsilon float64      // for biased summaries
+	hra     bool         // for biased summaries
+}
+
+// CKMSTarget is a quantile and its allowed normalized rank error.
+type CKMSTarget struct {
+	Quantile float64
+	Epsilon  float64
+}
+
+// ckmsBufferSize is the number of values buffered before merged into
+// tuples.
+const ckmsBufferSize = 500
+
+// ErrInvalidTarget is returned when the targets of CKMSSummary are empty
+// or a quantile of the targets is not in the range (0, 1).
+var ErrInvalidTarget = errors.New("targets must not be empty and quantiles must be in the range (0, 1)")
+
+// NewCKMSSummary creates a CKMSSummary accurate at targets. It panics if
+// targets are invalid.
+func NewCKMSSummary(targets []CKMSTarget) *CKMSSummary {
+	s, err := NewCKMSSummaryE(targets)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// NewCKMSSummaryE creates a CKMSSummary accurate at targets. It returns
+// ErrInvalidTarget if targets are empty or a quantile is not in the range
+// (0, 1), and ErrInvalidEpsilon if an epsilon is not in the range (0, 0.5].
+func NewCKMSSummaryE(targets []CKMSTarget) (*CKMSSummary, error) {
+	if len(targets) == 0 {
+		return nil, ErrInvalidTarget
+	}
+	for _, t := range targets {
+		if !(t.Quantile > 0 && t.Quantile < 1) {
+			return nil, ErrInvalidTarget
+		}
+		if !(t.Epsilon > 0 && t.Epsilon <= 0.5) {
+			return nil, ErrInvalidEpsilon
+		}
+	}
+	return &CKMSSummary{
+		targets: append([]CKMSTarget(nil), targets...),
+	}, nil
+}
+
+// NewBiasedCKMSSummary creates a CKMSSummary with relative rank error. It
+// panics if epsilon is invalid.
+// @param highRankAccuracy if true, the rank error at the normalized rank p
+// is epsilon*(1-p), which is suitable for high percentiles. Otherwise the
+// rank error is epsilon*p.
+func NewBiasedCKMSSummary(epsilon float64, highRankAccuracy bool) *CKMSSummary {
+	s, err := NewBiasedCKMSSummaryE(epsilon, highRankAccuracy)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// NewBiasedCKMSSummaryE creates a CKMSSummary with relative rank error.
+// It returns ErrInvalidEpsilon if epsilon is not in the range (0, 0.5].
+func NewBiasedCKMSSummaryE(epsilon float64, highRankAccuracy bool) (*CKMSSummary, error) {
+	if !(epsilon > 0 && epsilon <= 0.5) {
+		return nil, ErrInvalidEpsilon
+	}
+	return &CKMSSummary{
+		epsilon: epsilon,
+		hra:     highRankAccuracy,
+	}, nil
+}
+
+// Add adds v. Values are buffered and merged into the tuples in batches.
+func (s *CKMSSummary) Add(v float64) {
+	s.buffer = append(s.buffer, v)
+	if len(s.buffer) >= ckmsBufferSize {
+		s.flush()
+	}
+}
+
+// Quantile returns the approximate value at the normalized rank p.
+func (s *CKMSSummary) Quantile(p float64) (float64, error) {
+	s.flush()
+	if len(s.tuples) == 0 {
+		return 0, errNoValueAdded
+	}
+	if err := checkNormalizedRankBounds(p); err != nil {
+		return 0, err
+	}
+
+	// Return the last value whose maximum rank does not exceed the
+	// wanted rank plus half the allowed error.
+	rank := math.Ceil(p * float64(s.n))
+	rank += math.Ceil(s.invariant(rank) / 2)
+	rMin := 0
+	for i := 1; i < len(s.tuples); i++ {
+		rMin += s.tuples[i-1].gap
+		t := &s.tuples[i]
+		if float64(rMin+t.gap+t.delta) > rank {
+			return s.tuples[i-1].value, nil
+		}
+	}
+	return s.tuples[len(s.tuples)-1].value, nil
+}
+
+// Count returns the number of values added.
+func (s *CKMSSummary) Count() int { return s.n + len(s.buffer) }
+
+// NumTuples returns the number of tuples retained in the summary after
+// merging the buffered values.
+func (s *CKMSSummary) NumTuples() int {
+	s.flush()
+	return len(s.tuples)
+}
+
+// Min returns the minimum value added.
+func (s *CKMSSummary) Min() (float64, error) {
+	s.flush()
+	if len(s.tuples) == 0 {
+		return 0, errNoValueAdded
+	}
+	return s.tuples[0].value, nil
+}
+
+// Max returns the maximum value added.
+func (s *CKMSSummary) Max() (float64, error) {
+	s.flush()
+	if len(s.tuples) == 0 {
+		return 0, errNoValueAdded
+	}
+	return s.tuples[len(s.tuples)-1].value, nil
+}
+
+// Reset removes all values while keeping the targets or epsilon.
+func (s *CKMSSummary) Reset() {
+	s.tuples = s.tuples[:0]
+	s.buffer = s.buffer[:0]
+	s.n = 0
+}
+
+// Validate checks the internal invariants of the summary and returns an
+// error describing the first violation found. It is intended for tests and
+// debugging. Buffered values are not merged before the check.
+func (s *CKMSSummary) Validate() error {
+	if len(s.buffer) >= ckmsBufferSize {
+		return fmt.Errorf("buffer not flushed, len=%d", len(s.buffer))
+	}
+	r := 0 // number of values before tuple i
+	for i := range s.tuples {
+		t := &s.tuples[i]
+		if i > 0 && t.value < s.tuples[i-1].value {
+			return fmt.Errorf("tuples not sorted, i=%d, value=%g, prev=%g", i, t.value, s.tuples[i-1].value)
+		}
+		if t.gap < 1 || t.delta < 0 {
+			return fmt.Errorf("invalid tuple, i=%d, gap=%d, delta=%d", i, t.gap, t.delta)
+		}
+		width := t.gap + t.delta
+		// a small tolerance for rounding errors
+		if bound := math.Max(1, s.invariantRange(float64(r), float64(r+width))); float64(width) > bound*(1+1e-9) {
+			return fmt.Errorf("gap+delta exceeds invariant, i=%d, gap=%d, delta=%d, bound=%g", i, t.gap, t.delta, bound)
+		}
+		r += t.gap
+	}
+	if r != s.n {
+		return fmt.Errorf("sum of gaps mismatch, got=%d, want=%d", r, s.n)
+	}
+	return nil
+}
+
+// invariant returns the allowed rank error at the rank r. For a target
+// (phi, epsilon), it is 2*epsilon*r/phi for r >= phi*n and
+// 2*epsilon*(n-r)/(1-phi) otherwise, and the minimum over all targets is
+// used.
+func (s *CKMSSummary) invariant(r float64) float64 {
+	return s.invariantRange(r, r)
+}
+
+// invariantRange returns the minimum of invariant over the ranks [a, b],
+// which is the allowed gap+delta of a tuple preceded by a values whose
+// maximum rank is b. Bounding gap+delta over the whole range, instead of
+// at a only as in the paper, keeps the rank error at a target within its
+// epsilon when the invariant decreases toward the target.
+//
+// The invariant for each target is V-shaped with the minimum 2*epsilon*n
+// at phi*n, so the minimum over the range is at the rank in the range
+// nearest to phi*n. It does not decrease as values are added, since
+// neither the ranks nor n minus the ranks decrease for a tuple.
+func (s *CKMSSummary) invariantRange(a, b float64) float64 {
+	n := float64(s.n)
+	if s.targets == nil {
+		if s.hra {
+			return 2 * s.epsilon * (n - b)
+		}
+		return 2 * s.epsilon * a
+	}
+	f := math.MaxFloat64
+	for _, t := range s.targets {
+		r := math.Max(a, math.Min(b, t.Quantile*n))
+		var ft float64
+		if r >= t.Quantile*n {
+			ft = 2 * t.Epsilon * r / t.Quantile
+		} else {
+			ft = 2 * t.Epsilon * (n - r) / (1 - t.Quantile)
+		}
+		if ft < f {
+			f = ft
+		}
+	}
+	return f
+}
+
+// flush merges the buffered values into the tuples and compresses them.
+// A value inserted between two tuples preceded by r values gets the
+// largest delta satisfying the invariant over the ranks it may have,
+// computed with n including the values inserted so far. A value inserted
+// before the first or after the last tuple gets the delta of 0.
+func (s *CKMSSummary) flush() {
+	if len(s.buffer) == 0 {
+		return
+	}
+	sort.Float64s(s.buffer)
+
+	merged := make([]tuple, 0, len(s.tuples)+len(s.buffer))
+	r := 0
+	var i, j int
+	for i < len(s.tuples) || j < len(s.buffer) {
+		// a buffered value is inserted before the tuples of equal values
+		if j < len(s.buffer) && (i == len(s.tuples) || s.buffer[j] <= s.tuples[i].value) {
+			t := tuple{value: s.buffer[j], gap: 1}
+			s.n++
+			if i > 0 && i < len(s.tuples) {
+				// shrinking the range to [r, r+1+delta] only increases
+				// the minimum, so delta satisfies the invariant.
+				delta := int(math.Floor(s.invariant(float64(r)))) - 1
+				delta = int(math.Floor(s.invariantRange(float64(r), float64(r+1+delta)))) - 1
+				if delta > 0 {
+					t.delta = delta
+				}
+			}
+			merged = append(merged, t)
+			r++
+			j++
+		} else {
+			merged = append(merged, s.tuples[i])
+			r += s.tuples[i].gap
+			i++
+		}
+	}
+	s.tuples = merged
+	s.buffer = s.buffer[:0]
+	s.compress()
+}
+
+// compress merges each tuple into its right neighbor while the merged
+// tuple satisfies the invariant. The first tuple, which holds the minimum
+// value, is never merged.
+func (s *CKMSSummary) compress() {
+	if len(s.tuples) < 3 {
+		return
+	}
+	// Kept tuples are moved to the end of s.tuples, and w is the index
+	// of the right neighbor of tuple i in the result.
+	w := len(s.tuples) - 1
+	r := s.n - s.tuples[w].gap // number of values before tuple i+1
+	for i := len(s.tuples) - 2; i >= 1; i-- {
+		t := &s.tuples[i]
+		r -= t.gap
+		right := &s.tuples[w]
+		width := t.gap + right.gap + right.delta
+		if float64(width) <= s.invariantRange(float64(r), float64(r+width)) {
+			right.gap += t.gap
+			continue
+		}
+		w--
+		s.tuples[w] = *t
+	}
+	w--
+	s.tuples[w] = s.tuples[0]
+	n := copy(s.tuples, s.tuples[w:])
+	s.tuples = s.tuples[:n]
+}
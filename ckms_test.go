@@ -0,0 +1,199 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/exp/slices"
+	"pgregory.net/rapid"
+)
+
+func TestCKMSSummary(t *testing.T) {
+	testCases := []struct {
+		name    string
+		s       *CKMSSummary
+		inputs  []float64
+		pValues []float64
+		want    []float64
+	}{
+		{
+			name:    "lowBiased",
+			s:       NewBiasedCKMSSummary(0.01, false),
+			inputs:  []float64{12, 6, 10, 1},
+			pValues: []float64{0, 0.25, 0.5, 0.75, 1},
+			want:    []float64{1, 6, 10, 12, 12},
+		},
+		{
+			name:    "highBiased",
+			s:       NewBiasedCKMSSummary(0.01, true),
+			inputs:  []float64{12, 6, 10, 1},
+			pValues: []float64{0, 0.25, 0.5, 0.75, 1},
+			want:    []float64{1, 6, 10, 12, 12},
+		},
+		{
+			name:    "targeted",
+			s:       NewCKMSSummary([]CKMSTarget{{Quantile: 0.5, Epsilon: 0.01}}),
+			inputs:  []float64{12, 6, 10, 1},
+			pValues: []float64{0, 0.25, 0.5, 0.75, 1},
+			want:    []float64{1, 6, 10, 12, 12},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, v := range tc.inputs {
+				tc.s.Add(v)
+			}
+			got := make([]float64, len(tc.pValues))
+			for i, p := range tc.pValues {
+				v, err := tc.s.Quantile(p)
+				if err != nil {
+					t.Fatalf("quantile: p=%g, err=%s", p, err)
+				}
+				got[i] = v
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("result mismatch, got=%v, want=%v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewCKMSSummaryE(t *testing.T) {
+	testCases := []struct {
+		targets []CKMSTarget
+		want    error
+	}{
+		{targets: []CKMSTarget{{Quantile: 0.99, Epsilon: 0.001}}, want: nil},
+		{targets: nil, want: ErrInvalidTarget},
+		{targets: []CKMSTarget{{Quantile: 0, Epsilon: 0.01}}, want: ErrInvalidTarget},
+		{targets: []CKMSTarget{{Quantile: 1, Epsilon: 0.01}}, want: ErrInvalidTarget},
+		{targets: []CKMSTarget{{Quantile: math.NaN(), Epsilon: 0.01}}, want: ErrInvalidTarget},
+		{targets: []CKMSTarget{{Quantile: 0.5, Epsilon: 0}}, want: ErrInvalidEpsilon},
+		{targets: []CKMSTarget{{Quantile: 0.5, Epsilon: 0.6}}, want: ErrInvalidEpsilon},
+	}
+	for i, tc := range testCases {
+		if _, err := NewCKMSSummaryE(tc.targets); err != tc.want {
+			t.Errorf("error mismatch, case=%d, got=%v, want=%v", i, err, tc.want)
+		}
+	}
+
+	for _, epsilon := range []float64{0, -0.1, 0.6, math.NaN()} {
+		if _, err := NewBiasedCKMSSummaryE(epsilon, true); err != ErrInvalidEpsilon {
+			t.Errorf("error mismatch, epsilon=%g, got=%v, want=%v", epsilon, err, ErrInvalidEpsilon)
+		}
+	}
+}
+
+func TestCKMSSummary_MinMaxReset(t *testing.T) {
+	s := NewBiasedCKMSSummary(0.01, true)
+	if _, err := s.Quantile(0.5); err != errNoValueAdded {
+		t.Errorf("error mismatch, got=%v, want=%v", err, errNoValueAdded)
+	}
+	for i := 0; i < 10000; i++ {
+		s.Add(float64(i))
+	}
+	if got, err := s.Min(); err != nil || got != 0 {
+		t.Errorf("min mismatch, got=%g, err=%v, want=0", got, err)
+	}
+	if got, err := s.Max(); err != nil || got != 9999 {
+		t.Errorf("max mismatch, got=%g, err=%v, want=9999", got, err)
+	}
+	if got, want := s.Count(), 10000; got != want {
+		t.Errorf("count mismatch, got=%d, want=%d", got, want)
+	}
+	s.Reset()
+	if got, want := s.Count(), 0; got != want {
+		t.Errorf("count mismatch after reset, got=%d, want=%d", got, want)
+	}
+	if _, err := s.Min(); err != errNoValueAdded {
+		t.Errorf("error mismatch, got=%v, want=%v", err, errNoValueAdded)
+	}
+}
+
+func TestCKMSSummary_PropertyTargetedCompareToNaive(t *testing.T) {
+	targets := []CKMSTarget{
+		{Quantile: 0.5, Epsilon: 0.05},
+		{Quantile: 0.9, Epsilon: 0.01},
+		{Quantile: 0.99, Epsilon: 0.001},
+	}
+	rapid.Check(t, func(t *rapid.T) {
+		seed := rapid.Int64().Draw(t, "seed")
+		s := NewCKMSSummary(targets)
+		sRef := &SummaryNaiveImpl{}
+		rnd := rand.New(rand.NewSource(seed))
+		n := 1 + rnd.Intn(20000)
+		for i := 0; i < n; i++ {
+			v := rnd.Float64()
+			s.Add(v)
+			checkValid(t, s)
+			sRef.Add(v)
+		}
+
+		for _, target := range targets {
+			v, err := s.Quantile(target.Quantile)
+			if err != nil {
+				t.Fatalf("quantile: p=%g, err=%s", target.Quantile, err)
+			}
+			gotRank := sRef.Rank(v)
+			wantRank := int(math.Ceil(target.Quantile * float64(n)))
+			margin := int(math.Ceil(target.Epsilon*float64(n))) + 1
+			if gotRank < wantRank-margin || gotRank > wantRank+margin {
+				t.Fatalf("quantile rank out of range, p=%g, v=%g, gotRank=%d, wantRank=%d, margin=%d",
+					target.Quantile, v, gotRank, wantRank, margin)
+			}
+		}
+	})
+}
+
+func TestCKMSSummary_PropertyBiasedCompareToNaive(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		seed := rapid.Int64().Draw(t, "seed")
+		hra := rapid.Bool().Draw(t, "hra")
+		const epsilon = 0.01
+		s := NewBiasedCKMSSummary(epsilon, hra)
+		sRef := &SummaryNaiveImpl{}
+		rnd := rand.New(rand.NewSource(seed))
+		n := 1 + rnd.Intn(20000)
+		for i := 0; i < n; i++ {
+			v := rnd.Float64()
+			s.Add(v)
+			checkValid(t, s)
+			sRef.Add(v)
+		}
+
+		pValues := []float64{0, 0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999, 1}
+		for _, p := range pValues {
+			v, err := s.Quantile(p)
+			if err != nil {
+				t.Fatalf("quantile: p=%g, err=%s", p, err)
+			}
+			gotRank := sRef.Rank(v)
+			wantRank := int(math.Ceil(p * float64(n)))
+			margin := int(math.Ceil(epsilon*reqRelativeRankFactor(p, hra)*float64(n))) + 1
+			if gotRank < wantRank-margin || gotRank > wantRank+margin {
+				t.Fatalf("quantile rank out of range, hra=%v, p=%g, v=%g, gotRank=%d, wantRank=%d, margin=%d",
+					hra, p, v, gotRank, wantRank, margin)
+			}
+		}
+	})
+}
+
+func TestCKMSSummary_Space(t *testing.T) {
+	targets := []CKMSTarget{
+		{Quantile: 0.5, Epsilon: 0.01},
+		{Quantile: 0.99, Epsilon: 0.001},
+	}
+	s := NewCKMSSummary(targets)
+	sUniform := NewSummary(0.001)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		v := rnd.Float64()
+		s.Add(v)
+		sUniform.Add(v)
+	}
+	// the uniform summary needs epsilon=0.001 for the p99 target.
+	if got, uniform := s.NumTuples(), sUniform.NumTuples(); got >= uniform {
+		t.Errorf("targeted summary must have fewer tuples, got=%d, uniform=%d", got, uniform)
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// DDSketch is a quantile sketch with relative value accuracy, which is
+// described in "DDSketch: A Fast and Fully-Mergeable Quantile Sketch with
+// Relative-Error Guarantees" by Charles Masson, Jee E. Rim and Homin K. Lee.
+// A quantile returned by the sketch is within relativeAccuracy of the
+// true value, that is, |estimated - actual| <= relativeAccuracy * |actual|.
+type DDSketch struct {
+	mapping ddIndexMapping
+	store   DDSketchStore
+
+	// state variables
+
+	zeroCount float64
+	minValue  float64
+	maxValue  float64
+
+	// objects
+
+	positiveStore ddStore
+	negativeStore ddStore // holds the absolute values of negative values
+}
+
+// DDSketchStore specifies how a DDSketch stores the counts of its bins.
+type DDSketchStore struct {
+	kind       ddStoreKind
+	maxNumBins int
+}
+
+type ddStoreKind int
+
+const (
+	ddStoreDense ddStoreKind = iota
+	ddStoreSparse
+	ddStoreCollapsingLowest
+	ddStoreCollapsingHighest
+)
+
+// DDSketchDenseStore returns a store which holds the counts in a contiguous
+// slice and grows without limit. It is fast when values are dense in the
+// logarithmic scale.
+func DDSketchDenseStore() DDSketchStore {
+	return DDSketchStore{kind: ddStoreDense}
+}
+
+// DDSketchSparseStore returns a store which holds the counts in a map and
+// grows without limit. It is small when values are sparse in the
+// logarithmic scale.
+func DDSketchSparseStore() DDSketchStore {
+	return DDSketchStore{kind: ddStoreSparse}
+}
+
+// DDSketchCollapsingLowestStore returns a dense store with at most
+// maxNumBins bins. When the limit is exceeded, the bins of the smallest
+// absolute values are collapsed, so the accuracy of high quantiles of
+// positive values is kept.
+func DDSketchCollapsingLowestStore(maxNumBins int) DDSketchStore {
+	if maxNumBins <= 0 {
+		panic("maxNumBins must be positive")
+	}
+	return DDSketchStore{kind: ddStoreCollapsingLowest, maxNumBins: maxNumBins}
+}
+
+// DDSketchCollapsingHighestStore returns a dense store with at most
+// maxNumBins bins. When the limit is exceeded, the bins of the largest
+// absolute values are collapsed, so the accuracy of low quantiles of
+// positive values is kept.
+func DDSketchCollapsingHighestStore(maxNumBins int) DDSketchStore {
+	if maxNumBins <= 0 {
+		panic("maxNumBins must be positive")
+	}
+	return DDSketchStore{kind: ddStoreCollapsingHighest, maxNumBins: maxNumBins}
+}
+
+var (
+	errDDSketchMappingMismatch = errors.New("both sketches must have the same relative accuracy")
+	errDDSketchValueOutOfRange = errors.New("absolute value is too large for DDSketch")
+)
+
+// NewDDSketch creates a DDSketch.
+// @param relativeAccuracy The relative accuracy of quantiles. It must be in
+// the range (0, 1), exclusive. 0.01 is a typical value.
+// @param store The store for the counts of positive and negative values.
+func NewDDSketch(relativeAccuracy float64, store DDSketchStore) *DDSketch {
+	if !(relativeAccuracy > 0 && relativeAccuracy < 1) {
+		panic("relativeAccuracy must be in the range (0, 1)")
+	}
+	return &DDSketch{
+		mapping:       newDDIndexMapping(relativeAccuracy),
+		store:         store,
+		minValue:      math.NaN(),
+		maxValue:      math.NaN(),
+		positiveStore: store.newStore(),
+		negativeStore: store.newStore(),
+	}
+}
+
+// Add adds v. It panics if v is NaN, or the absolute value of v exceeds
+// the largest indexable value, which includes infinities.
+func (s *DDSketch) Add(v float64) {
+	if math.IsNaN(v) {
+		panic("cannot add NaN")
+	}
+	if math.Abs(v) > s.mapping.maxIndexableValue {
+		panic(errDDSketchValueOutOfRange)
+	}
+	if s.empty() {
+		s.minValue = v
+		s.maxValue = v
+	} else {
+		if v < s.minValue {
+			s.minValue = v
+		}
+		if v > s.maxValue {
+			s.maxValue = v
+		}
+	}
+
+	switch {
+	case v > s.mapping.minIndexableValue:
+		s.positiveStore.add(s.mapping.index(v), 1)
+	case v < -s.mapping.minIndexableValue:
+		s.negativeStore.add(s.mapping.index(-v), 1)
+	default:
+		s.zeroCount++
+	}
+}
+
+// Quantile returns the approximate value at the normalized rank q, which
+// is within the relative accuracy of the value at rank floor(q*(n-1)) in
+// the sorted values.
+func (s *DDSketch) Quantile(q float64) (float64, error) {
+	if s.empty() {
+		return 0, errEmptySketch
+	}
+	if err := checkNormalizedRankBounds(q); err != nil {
+		return 0, err
+	}
+
+	rank := math.Floor(q * (s.count() - 1))
+	negativeCount := s.negativeStore.totalCount()
+	var v float64
+	switch {
+	case rank < negativeCount:
+		v = -s.mapping.value(ddKeyAtRank(s.negativeStore, negativeCount-1-rank))
+	case rank < negativeCount+s.zeroCount:
+		v = 0
+	default:
+		v = s.mapping.value(ddKeyAtRank(s.positiveStore, rank-negativeCount-s.zeroCount))
+	}
+	// the representative value of a bin may be beyond min or max
+	return math.Max(s.minValue, math.Min(v, s.maxValue)), nil
+}
+
+// Rank returns the approximate fraction of values less than or equal to v.
+func (s *DDSketch) Rank(v float64) (float64, error) {
+	if s.empty() {
+		return 0, errEmptySketch
+	}
+	if math.IsNaN(v) {
+		return 0, errNaNRankItem
+	}
+
+	var count float64
+	switch {
+	case v > s.mapping.maxIndexableValue:
+		// no value added is larger than maxIndexableValue
+		return 1, nil
+	case v < -s.mapping.maxIndexableValue:
+		return 0, nil
+	case v > s.mapping.minIndexableValue:
+		index := s.mapping.index(v)
+		count = s.negativeStore.totalCount() + s.zeroCount
+		s.positiveStore.forEach(func(i int, c float64) bool {
+			if i > index {
+				return false
+			}
+			count += c
+			return true
+		})
+	case v < -s.mapping.minIndexableValue:
+		index := s.mapping.index(-v)
+		s.negativeStore.forEach(func(i int, c float64) bool {
+			if i >= index {
+				count += c
+			}
+			return true
+		})
+	default:
+		count = s.negativeStore.totalCount() + s.zeroCount
+	}
+	return count / s.count(), nil
+}
+
+// Count returns the number of values added.
+func (s *DDSketch) Count() int { return int(s.count()) }
+
+// Min returns the minimum value added.
+func (s *DDSketch) Min() (float64, error) {
+	if s.empty() {
+		return 0, errEmptySketch
+	}
+	return s.minValue, nil
+}
+
+// Max returns the maximum value added.
+func (s *DDSketch) Max() (float64, error) {
+	if s.empty() {
+		return 0, errEmptySketch
+	}
+	return s.maxValue, nil
+}
+
+// Merge merges o, which must have the same relative accuracy, into s.
+// The store of s is kept.
+func (s *DDSketch) Merge(o *DDSketch) error {
+	if o.mapping.gamma != s.mapping.gamma {
+		return errDDSketchMappingMismatch
+	}
+	if o.empty() {
+		return nil
+	}
+
+	if s.empty() || o.minValue < s.minValue {
+		s.minValue = o.minValue
+	}
+	if s.empty() || o.maxValue > s.maxValue {
+		s.maxValue = o.maxValue
+	}
+	s.zeroCount += o.zeroCount
+	ddMergeStore(s.positiveStore, o.positiveStore)
+	ddMergeStore(s.negativeStore, o.negativeStore)
+	return nil
+}
+
+// Reset removes all values while keeping the relative accuracy and
+// the store.
+func (s *DDSketch) Reset() {
+	*s = *NewDDSketch(s.mapping.relativeAccuracy, s.store)
+}
+
+// NumBins returns the number of non-empty bins.
+func (s *DDSketch) NumBins() int {
+	n := 0
+	for _, st := range []ddStore{s.positiveStore, s.negativeStore} {
+		st.forEach(func(i int, c float64) bool {
+			n++
+			return true
+		})
+	}
+	return n
+}
+
+func (s *DDSketch) count() float64 {
+	return s.negativeStore.totalCount() + s.zeroCount + s.positiveStore.totalCount()
+}
+
+func (s *DDSketch) empty() bool { return s.count() == 0 }
+
+// ddIndexMapping maps a positive value v to the index ceil(log_gamma(v)),
+// that is, bin i holds values in (gamma^(i-1), gamma^i]. Values in
+// (minIndexableValue, maxIndexableValue] are mapped to indexes within the
+// range of int32 whose representative values are finite.
+type ddIndexMapping struct {
+	relativeAccuracy  float64
+	gamma             float64
+	lnGamma           float64
+	minIndexableValue float64
+	maxIndexableValue float64
+}
+
+func newDDIndexMapping(relativeAccuracy float64) ddIndexMapping {
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	lnGamma := math.Log(gamma)
+	const minNormalFloat64 = 0x1p-1022
+	return ddIndexMapping{
+		relativeAccuracy: relativeAccuracy,
+		gamma:            gamma,
+		lnGamma:          lnGamma,
+		minIndexableValue: math.Max(
+			math.Exp(float64(math.MinInt32+1)*lnGamma),
+			minNormalFloat64*gamma,
+		),
+		// gamma^index, which is less than v*gamma, must not overflow.
+		maxIndexableValue: math.Min(
+			math.Exp(float64(math.MaxInt32-1)*lnGamma),
+			math.MaxFloat64/gamma,
+		),
+	}
+}
+
+func (m ddIndexMapping) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / m.lnGamma))
+}
+
+// value returns the representative value of bin index, which is within
+// the relative accuracy of any value in the bin.
+func (m ddIndexMapping) value(index int) float64 {
+	return math.Exp(float64(index)*m.lnGamma) * 2 / (1 + m.gamma)
+}
+
+// ddStore holds counts of bins.
+type ddStore interface {
+	add(index int, count float64)
+	totalCount() float64
+	// forEach calls f for non-empty bins in ascending order of index
+	// until f returns false.
+	forEach(f func(index int, count float64) bool)
+}
+
+func (st DDSketchStore) newStore() ddStore {
+	switch st.kind {
+	case ddStoreSparse:
+		return &ddSparseStore{counts: make(map[int]float64)}
+	case ddStoreCollapsingLowest:
+		return &ddDenseStore{maxNumBins: st.maxNumBins, collapseHighest: false}
+	case ddStoreCollapsingHighest:
+		return &ddDenseStore{maxNumBins: st.maxNumBins, collapseHighest: true}
+	default:
+		return &ddDenseStore{}
+	}
+}
+
+// ddKeyAtRank returns the index of the bin which contains the item at rank.
+func ddKeyAtRank(st ddStore, rank float64) int {
+	key := 0
+	cum := 0.0
+	st.forEach(func(i int, c float64) bool {
+		key = i
+		cum += c
+		return cum <= rank
+	})
+	return key
+}
+
+func ddMergeStore(dst, src ddStore) {
+	type bin struct {
+		index int
+		count float64
+	}
+	// collect bins first in case dst == src
+	var bins []bin
+	src.forEach(func(i int, c float64) bool {
+		bins = append(bins, bin{index: i, count: c})
+		return true
+	})
+	for _, b := range bins {
+		dst.add(b.index, b.count)
+	}
+}
+
+// ddDenseStore holds counts of bins from minIndex to maxIndex in a slice.
+// If maxNumBins is positive, the lowest (or highest if collapseHighest
+// is true) bins are collapsed so that the number of bins does not exceed it.
+type ddDenseStore struct {
+	counts          []float64 // counts[i] is the count of bin minIndex+i
+	minIndex        int
+	count           float64
+	maxNumBins      int
+	collapseHighest bool
+}
+
+func (st *ddDenseStore) add(index int, count float64) {
+	if count == 0 {
+		return
+	}
+	if len(st.counts) == 0 {
+		st.counts = []float64{count}
+		st.minIndex = index
+		st.count = count
+		return
+	}
+
+	maxIndex := st.maxIndex()
+	if index < st.minIndex || index > maxIndex {
+		newMin := minInt(st.minIndex, index)
+		newMax := maxInt(maxIndex, index)
+		if st.maxNumBins > 0 && newMax-newMin+1 > st.maxNumBins {
+			if st.collapseHighest {
+				newMax = newMin + st.maxNumBins - 1
+			} else {
+				newMin = newMax - st.maxNumBins + 1
+			}
+		}
+		st.resize(newMin, newMax)
+		index = maxInt(newMin, minInt(index, newMax))
+	}
+	st.counts[index-st.minIndex] += count
+	st.count += count
+}
+
+// resize changes the range of bins to [newMin, newMax] and collapses
+// the counts of bins outside of the range into the nearest bin.
+func (st *ddDenseStore) resize(newMin, newMax int) {
+	counts := make([]float64, newMax-newMin+1)
+	for i, c := range st.counts {
+		index := maxInt(newMin, minInt(st.minIndex+i, newMax))
+		counts[index-newMin] += c
+	}
+	st.counts = counts
+	st.minIndex = newMin
+}
+
+func (st *ddDenseStore) maxIndex() int { return st.minIndex + len(st.counts) - 1 }
+
+func (st *ddDenseStore) totalCount() float64 { return st.count }
+
+func (st *ddDenseStore) forEach(f func(index int, count float64) bool) {
+	for i, c := range st.counts {
+		if c == 0 {
+			continue
+		}
+		if !f(st.minIndex+i, c) {
+			return
+		}
+	}
+}
+
+// ddSparseStore holds counts of non-empty bins in a map.
+type ddSparseStore struct {
+	counts map[int]float64
+	count  float64
+}
+
+func (st *ddSparseStore) add(index int, count float64) {
+	if count == 0 {
+		return
+	}
+	st.counts[index] += count
+	st.count += count
+}
+
+func (st *ddSparseStore) totalCount() float64 { return st.count }
+
+func (st *ddSparseStore) forEach(f func(index int, count float64) bool) {
+	indexes := make([]int, 0, len(st.counts))
+	for i := range st.counts {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		if !f(i, st.counts[i]) {
+			return
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"pgregory.net/rapid"
+)
+
+var ddSketchTestStores = []struct {
+	name  string
+	store DDSketchStore
+}{
+	{name: "Dense", store: DDSketchDenseStore()},
+	{name: "Sparse", store: DDSketchSparseStore()},
+	{name: "CollapsingLowest", store: DDSketchCollapsingLowestStore(2048)},
+	{name: "CollapsingHighest", store: DDSketchCollapsingHighestStore(2048)},
+}
+
+func TestDDSketch(t *testing.T) {
+	const relativeAccuracy = 0.01
+	for _, st := range ddSketchTestStores {
+		s := NewDDSketch(relativeAccuracy, st.store)
+		for _, v := range []float64{12, -6, 0, 10, 1} {
+			s.Add(v)
+		}
+		testCases := []struct {
+			q    float64
+			want float64
+		}{
+			{q: 0, want: -6},
+			{q: 0.25, want: 0},
+			{q: 0.5, want: 1},
+			{q: 0.75, want: 10},
+			{q: 1, want: 12},
+		}
+		for _, tc := range testCases {
+			got, err := s.Quantile(tc.q)
+			if err != nil {
+				t.Fatalf("quantile: store=%s, q=%g, err=%s", st.name, tc.q, err)
+			}
+			if math.Abs(got-tc.want) > relativeAccuracy*math.Abs(tc.want) {
+				t.Errorf("result mismatch, store=%s, q=%g, got=%g, want=%g", st.name, tc.q, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestDDSketch_Rank(t *testing.T) {
+	s := NewDDSketch(0.01, DDSketchDenseStore())
+	for _, v := range []float64{12, -6, 0, 10, 1} {
+		s.Add(v)
+	}
+	testCases := []struct {
+		value float64
+		want  float64
+	}{
+		{value: -7, want: 0},
+		{value: -6, want: 0.2},
+		{value: -1, want: 0.2},
+		{value: 0, want: 0.4},
+		{value: 5, want: 0.6},
+		{value: 11, want: 0.8},
+		{value: 12, want: 1},
+	}
+	for _, tc := range testCases {
+		got, err := s.Rank(tc.value)
+		if err != nil {
+			t.Fatalf("rank: value=%g, err=%s", tc.value, err)
+		}
+		if got != tc.want {
+			t.Errorf("rank mismatch, value=%g, got=%g, want=%g", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestDDSketch_OutOfRange(t *testing.T) {
+	for _, st := range ddSketchTestStores {
+		s := NewDDSketch(0.01, st.store)
+		maxValue := s.mapping.maxIndexableValue
+		for _, v := range []float64{math.Inf(1), math.Inf(-1), math.MaxFloat64, -math.MaxFloat64, math.Nextafter(maxValue, math.Inf(1))} {
+			func() {
+				defer func() {
+					if got, want := recover(), errDDSketchValueOutOfRange; got != want {
+						t.Errorf("panic value mismatch, store=%s, v=%g, got=%v, want=%v", st.name, v, got, want)
+					}
+				}()
+				s.Add(v)
+			}()
+		}
+		if !s.empty() {
+			t.Fatalf("values out of range must not be added, store=%s", st.name)
+		}
+
+		s.Add(1)
+		s.Add(maxValue)
+		s.Add(-maxValue)
+		testCases := []struct {
+			q    float64
+			want float64
+		}{
+			{q: 0, want: -maxValue},
+			{q: 0.5, want: 1},
+			{q: 1, want: maxValue},
+		}
+		for _, tc := range testCases {
+			got, err := s.Quantile(tc.q)
+			if err != nil {
+				t.Fatalf("quantile: store=%s, q=%g, err=%s", st.name, tc.q, err)
+			}
+			// collapsing stores lose the accuracy of the collapsed bins.
+			if st.store.maxNumBins == 0 && math.Abs(got-tc.want) > 0.01*math.Abs(tc.want) {
+				t.Errorf("result mismatch, store=%s, q=%g, got=%g, want=%g", st.name, tc.q, got, tc.want)
+			}
+		}
+		rankCases := []struct {
+			value float64
+			want  float64
+		}{
+			{value: math.Inf(-1), want: 0},
+			{value: -math.MaxFloat64, want: 0},
+			{value: math.MaxFloat64, want: 1},
+			{value: math.Inf(1), want: 1},
+		}
+		for _, tc := range rankCases {
+			if got, err := s.Rank(tc.value); err != nil || got != tc.want {
+				t.Errorf("rank mismatch, store=%s, value=%g, got=%g, err=%v, want=%g", st.name, tc.value, got, err, tc.want)
+			}
+		}
+	}
+}
+
+func TestDDSketch_PropertyRelativeAccuracy(t *testing.T) {
+	for _, st := range ddSketchTestStores[:2] {
+		t.Run(st.name, func(t *testing.T) {
+			rapid.Check(t, func(t *rapid.T) {
+				seed := rapid.Int64().Draw(t, "seed")
+				const relativeAccuracy = 0.01
+				s := NewDDSketch(relativeAccuracy, st.store)
+				sRef := &SummaryNaiveImpl{}
+				rnd := rand.New(rand.NewSource(seed))
+				n := 1 + rnd.Intn(5000)
+				for i := 0; i < n; i++ {
+					// a wide range of positive and negative values and zeros
+					v := math.Exp(rnd.NormFloat64() * 5)
+					switch rnd.Intn(4) {
+					case 0:
+						v = -v
+					case 1:
+						v = 0
+					}
+					s.Add(v)
+					sRef.Add(v)
+				}
+				checkRelativeValueError(t, AdaptDDSketch(s), sRef, relativeAccuracy, []float64{0, 0.01, 0.25, 0.5, 0.75, 0.99, 1})
+			})
+		})
+	}
+}
+
+func TestDDSketch_Collapsing(t *testing.T) {
+	const relativeAccuracy = 0.01
+	const maxNumBins = 1000
+	testCases := []struct {
+		store DDSketchStore
+		// quantiles which are still accurate after collapsing
+		pValues []float64
+	}{
+		{store: DDSketchCollapsingLowestStore(maxNumBins), pValues: []float64{0.9, 0.99, 1}},
+		{store: DDSketchCollapsingHighestStore(maxNumBins), pValues: []float64{0, 0.01, 0.1}},
+	}
+	for _, tc := range testCases {
+		s := NewDDSketch(relativeAccuracy, tc.store)
+		sRef := &SummaryNaiveImpl{}
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < 10000; i++ {
+			v := math.Exp(rnd.NormFloat64() * 5)
+			s.Add(v)
+			sRef.Add(v)
+		}
+		if got := s.NumBins(); got > maxNumBins {
+			t.Errorf("too many bins, got=%d, max=%d", got, maxNumBins)
+		}
+		checkRelativeValueError(t, AdaptDDSketch(s), sRef, relativeAccuracy, tc.pValues)
+	}
+}
+
+func TestDDSketch_Merge(t *testing.T) {
+	const relativeAccuracy = 0.01
+	s := NewDDSketch(relativeAccuracy, DDSketchDenseStore())
+	sRef := &SummaryNaiveImpl{}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 4; i++ {
+		s2 := NewDDSketch(relativeAccuracy, DDSketchSparseStore())
+		for j := 0; j < 1000; j++ {
+			v := rnd.NormFloat64() * 100
+			s2.Add(v)
+			sRef.Add(v)
+		}
+		if err := s.Merge(s2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRelativeValueError(t, AdaptDDSketch(s), sRef, relativeAccuracy, []float64{0, 0.01, 0.25, 0.5, 0.75, 0.99, 1})
+
+	if err := s.Merge(NewDDSketch(0.02, DDSketchDenseStore())); err != errDDSketchMappingMismatch {
+		t.Errorf("error mismatch, got=%v, want=%v", err, errDDSketchMappingMismatch)
+	}
+}
+
+// TestDDSketch_CompareRelativeErrors compares the value-relative error of
+// DDSketch with the rank-relative error of REQSketch on a heavy-tailed
+// distribution. DDSketch keeps values accurate even where a small rank
+// error makes a large value error, and REQSketch keeps ranks accurate even
+// where a small value error makes a large rank error.
+func TestDDSketch_CompareRelativeErrors(t *testing.T) {
+	const relativeAccuracy = 0.01
+	dd := NewDDSketch(relativeAccuracy, DDSketchDenseStore())
+	req := NewREQSketch[float64](12, true)
+	sRef := &SummaryNaiveImpl{}
+	rnd := rand.New(rand.NewSource(1))
+	const n = 100000
+	for i := 0; i < n; i++ {
+		v := math.Exp(rnd.NormFloat64() * 3)
+		dd.Add(v)
+		req.Add(v)
+		sRef.Add(v)
+	}
+
+	for _, p := range []float64{0.5, 0.9, 0.99, 0.999} {
+		want := sRef.values[int(p*(n-1))]
+		ddValue, err := dd.Quantile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqValue, err := req.Quantile(p, QuantileSearchCriteriaInclusive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ddValueErr := math.Abs(ddValue-want) / want
+		reqValueErr := math.Abs(reqValue-want) / want
+		ddRankErr := math.Abs(float64(sRef.Rank(ddValue)-1)/n - p)
+		reqRankErr := math.Abs(float64(sRef.Rank(reqValue)-1)/n - p)
+		t.Logf("p=%g, DDSketch: valueErr=%.4f rankErr=%.5f, REQSketch: valueErr=%.4f rankErr=%.5f",
+			p, ddValueErr, ddRankErr, reqValueErr, reqRankErr)
+
+		if ddValueErr > relativeAccuracy*(1+1e-9) {
+			t.Errorf("DDSketch value error out of bound, p=%g, got=%g, want<=%g", p, ddValueErr, relativeAccuracy)
+		}
+		if bound := reqRelativeRankErrorBound(12, true, p); reqRankErr > bound {
+			t.Errorf("REQSketch rank error out of bound, p=%g, got=%g, want<=%g", p, reqRankErr, bound)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"golang.org/x/exp/constraints"
+)
+
+// ForwardDecaySketch is a quantile sketch over items weighted by forward
+// decay, which is described in "Forward Decay: A Practical Time Decay
+// Model for Streaming Systems" by Graham Cormode, Vladislav Shkapenyuk,
+// Divesh Srivastava and Bojian Xu. An item added at time t has the weight
+// exp(lambda*(t-landmark)), so that at any time the weights relative to
+// the newest item decay exponentially with the age of items.
+//
+// Items are added to a REQSketch with integer weights, which are the
+// decayed weights in units of 1/forwardDecayWeightUnit rounded randomly
+// so that the expected weights are exact. To keep weights in the range of
+// int, the landmark is moved to the current time when the weight of a new
+// item would exceed forwardDecayMaxGrowth, and the retained items are
+// re-added with their weights scaled down.
+type ForwardDecaySketch[T constraints.Ordered] struct {
+	lambda   float64 // decay rate per second
+	landmark time.Time
+	clock    Clock
+
+	s      *REQSketch[T]
+	random *rand.Rand // for rounding weights
+}
+
+const (
+	// forwardDecayWeightUnit is the integer weight of an item added at
+	// the landmark.
+	forwardDecayWeightUnit = 1 << 10
+	// forwardDecayMaxGrowth is the maximum growth of weights since the
+	// landmark before renormalization.
+	forwardDecayMaxGrowth = 1 << 16
+	// forwardDecayRoundingSalt is mixed into the seed of the REQSketch to
+	// get the seed for rounding weights. It must differ from the golden
+	// ratio increment of REQSketch.newCompactorRandom, so that rounding
+	// does not make the same coin flips as any compactor.
+	forwardDecayRoundingSalt = 0xbf58476d1ce4e5b9
+)
+
+// ErrInvalidLambda is returned when the decay rate of ForwardDecaySketch
+// is not positive and finite.
+var ErrInvalidLambda = errors.New("lambda must be positive and finite")
+
+// NewForwardDecaySketch creates a ForwardDecaySketch. It panics if lambda
+// or k is invalid.
+// @param lambda the decay rate per second. The weight of an item halves
+// every ln(2)/lambda seconds.
+// @param k and highRankAccuracy are the same as NewREQSketch.
+// @param opts The seed for rounding weights is derived from the seed of the
+// REQSketch given by WithREQSketchOptions.
+func NewForwardDecaySketch[T constraints.Ordered](lambda float64, k int, highRankAccuracy bool, opts ...TimedSketchOption) *ForwardDecaySketch[T] {
+	s, err := NewForwardDecaySketchE[T](lambda, k, highRankAccuracy, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// NewForwardDecaySketchE creates a ForwardDecaySketch. It returns
+// ErrInvalidLambda if lambda is invalid, ErrInvalidK if k is invalid, or
+// ErrLessTypeMismatch if the item type of WithLess given by
+// WithREQSketchOptions does not match T.
+func NewForwardDecaySketchE[T constraints.Ordered](lambda float64, k int, highRankAccuracy bool, opts ...TimedSketchOption) (*ForwardDecaySketch[T], error) {
+	if !(lambda > 0 && !math.IsInf(lambda, 1)) {
+		return nil, ErrInvalidLambda
+	}
+	if err := checkK(k); err != nil {
+		return nil, err
+	}
+	cfg := newTimedSketchConfig(opts)
+	s, err := newREQSketchWithOptions[T](k, highRankAccuracy, NaNPolicyPanic, cfg.reqOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &ForwardDecaySketch[T]{
+		lambda:   lambda,
+		landmark: cfg.clock.Now(),
+		clock:    cfg.clock,
+		s:        s,
+		random:   rand.New(rand.NewSource(forwardDecayRoundingSeed(s.Seed()))),
+	}, nil
+}
+
+// forwardDecayRoundingSeed returns the seed for rounding weights derived
+// from the seed of the REQSketch.
+func forwardDecayRoundingSeed(seed int64) int64 {
+	return int64(uint64(seed) ^ forwardDecayRoundingSalt)
+}
+
+// Add adds item with the weight for the current time. NaN is handled in
+// the same way as REQSketch.AddWeighted. If the clock goes backwards
+// before the landmark, item is added with the weight at the landmark.
+func (s *ForwardDecaySketch[T]) Add(item T) {
+	if isNaN(item) {
+		if err := s.s.handleNaN(); err != nil {
+			panic(err)
+		}
+		return
+	}
+	now := s.now()
+	growth := s.growth(now)
+	if growth > forwardDecayMaxGrowth {
+		s.renormalize(now, growth)
+		growth = 1
+	}
+	if weight := s.roundWeight(growth * forwardDecayWeightUnit); weight > 0 {
+		s.s.AddWeighted(item, weight)
+	}
+}
+
+// Quantile returns the approximate item at the normalized rank of the
+// decayed weights with the same semantics as REQSketch.Quantile.
+func (s *ForwardDecaySketch[T]) Quantile(normRank float64, searchCrit QuantileSearchCriteria) (T, error) {
+	return s.s.Quantile(normRank, searchCrit)
+}
+
+// Quantiles returns the approximate items at normRanks of the decayed
+// weights with the same semantics as REQSketch.Quantiles.
+func (s *ForwardDecaySketch[T]) Quantiles(normRanks []float64, searchCrit QuantileSearchCriteria) ([]T, error) {
+	return s.s.Quantiles(normRanks, searchCrit)
+}
+
+// Rank returns the approximate normalized rank of item by the decayed
+// weights with the same semantics as REQSketch.Rank.
+func (s *ForwardDecaySketch[T]) Rank(item T, searchCrit QuantileSearchCriteria) (float64, error) {
+	return s.s.Rank(item, searchCrit)
+}
+
+// DecayedCount returns the sum of the decayed weights of the items at the
+// current time, where an item added now has the weight 1.
+func (s *ForwardDecaySketch[T]) DecayedCount() float64 {
+	return float64(s.s.N()) / forwardDecayWeightUnit / s.growth(s.now())
+}
+
+// Reset removes all items and moves the landmark to the current time.
+func (s *ForwardDecaySketch[T]) Reset() {
+	s.s.Reset()
+	s.landmark = s.clock.Now()
+}
+
+// now returns the current time, or the landmark if the clock went
+// backwards before it, so that weights are never less than the one at the
+// landmark.
+func (s *ForwardDecaySketch[T]) now() time.Time {
+	now := s.clock.Now()
+	if now.Before(s.landmark) {
+		return s.landmark
+	}
+	return now
+}
+
+// growth returns exp(lambda*(now-landmark)).
+func (s *ForwardDecaySketch[T]) growth(now time.Time) float64 {
+	return math.Exp(s.lambda * now.Sub(s.landmark).Seconds())
+}
+
+// roundWeight rounds w to floor(w) or ceil(w) randomly so that the
+// expected value is w.
+func (s *ForwardDecaySketch[T]) roundWeight(w float64) int {
+	i, frac := math.Modf(w)
+	if s.random.Float64() < frac {
+		i++
+	}
+	return int(i)
+}
+
+// renormalize moves the landmark to now, and re-adds the retained items
+// to a new REQSketch with their weights divided by growth. Items whose
+// weights are rounded to zero are dropped. The new REQSketch is seeded
+// from the rounding random source, so that its compactors do not restart
+// the coin flips of the old one while staying reproducible.
+func (s *ForwardDecaySketch[T]) renormalize(now time.Time, growth float64) {
+	old := s.s
+	cfg := old.config()
+	cfg.seed = s.random.Int63()
+	s.s = newREQSketch(old.k, old.hra, cfg, old.less)
+	for h := range old.compactors {
+		for _, item := range old.compactors[h].buf.items() {
+			if weight := s.roundWeight(float64(int(1)<<h) / growth); weight > 0 {
+				s.s.AddWeighted(item, weight)
+			}
+		}
+	}
+	s.landmark = now
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"pgregory.net/rapid"
+)
+
+func TestNewForwardDecaySketchE(t *testing.T) {
+	testCases := []struct {
+		lambda float64
+		k      int
+		want   error
+	}{
+		{lambda: 0.1, k: 12, want: nil},
+		{lambda: 0, k: 12, want: ErrInvalidLambda},
+		{lambda: -0.1, k: 12, want: ErrInvalidLambda},
+		{lambda: math.Inf(1), k: 12, want: ErrInvalidLambda},
+		{lambda: math.NaN(), k: 12, want: ErrInvalidLambda},
+		{lambda: 0.1, k: 3, want: ErrInvalidK},
+	}
+	for i, tc := range testCases {
+		if _, err := NewForwardDecaySketchE[float64](tc.lambda, tc.k, true); err != tc.want {
+			t.Errorf("error mismatch, case=%d, got=%v, want=%v", i, err, tc.want)
+		}
+	}
+	less := WithLess(func(a, b int) bool { return a < b })
+	if _, err := NewForwardDecaySketchE[float64](0.1, 12, true, WithREQSketchOptions(less)); err != ErrLessTypeMismatch {
+		t.Errorf("error mismatch, got=%v, want=%v", err, ErrLessTypeMismatch)
+	}
+}
+
+func TestForwardDecaySketch_HalfLife(t *testing.T) {
+	const halfLife = 10 * time.Second
+	clock := newFakeClock()
+	s := NewForwardDecaySketch[float64](math.Ln2/halfLife.Seconds(), 12, true,
+		WithClock(clock), WithREQSketchOptions(WithDeterministic()))
+	for i := 0; i < 1000; i++ {
+		s.Add(1)
+	}
+	clock.Advance(halfLife)
+	for i := 0; i < 1000; i++ {
+		s.Add(2)
+	}
+
+	// the items of 1 have half the weight of the items of 2.
+	if got, want := s.DecayedCount(), 1500.0; math.Abs(got-want) > want*0.01 {
+		t.Errorf("decayed count mismatch, got=%g, want=%g", got, want)
+	}
+	if got, err := s.Rank(1, QuantileSearchCriteriaInclusive); err != nil || math.Abs(got-1.0/3) > 0.01 {
+		t.Errorf("rank mismatch, got=%g, err=%v, want=%g", got, err, 1.0/3)
+	}
+	if got, err := s.Quantile(0.5, QuantileSearchCriteriaInclusive); err != nil || got != 2 {
+		t.Errorf("quantile mismatch, got=%g, err=%v, want=2", got, err)
+	}
+
+	s.Reset()
+	if got, want := s.DecayedCount(), 0.0; got != want {
+		t.Errorf("decayed count mismatch after reset, got=%g, want=%g", got, want)
+	}
+}
+
+func TestForwardDecaySketch_ClockBackwards(t *testing.T) {
+	const halfLife = time.Second
+	clock := newFakeClock()
+	s := NewForwardDecaySketch[float64](math.Ln2/halfLife.Seconds(), 12, true,
+		WithClock(clock), WithREQSketchOptions(WithDeterministic()))
+	clock.Advance(-100 * halfLife)
+	for i := 0; i < 100; i++ {
+		s.Add(1)
+	}
+	// items are added with the weight at the landmark instead of being
+	// rounded to zero.
+	if got, want := s.DecayedCount(), 100.0; got != want {
+		t.Errorf("decayed count mismatch, got=%g, want=%g", got, want)
+	}
+
+	defer func() {
+		if got, want := recover(), ErrNaNItem; got != want {
+			t.Errorf("panic value mismatch, got=%v, want=%v", got, want)
+		}
+	}()
+	s.Add(math.NaN())
+}
+
+func TestForwardDecaySketch_NaNSkip(t *testing.T) {
+	clock := newFakeClock()
+	s := NewForwardDecaySketch[float64](0.1, 12, true,
+		WithClock(clock), WithREQSketchOptions(WithNaNPolicy(NaNPolicySkip)))
+	s.Add(math.NaN())
+	s.Add(1)
+	if got, want := s.s.NumNaNSkipped(), 1; got != want {
+		t.Errorf("numNaNSkipped mismatch, got=%d, want=%d", got, want)
+	}
+	if got, want := s.s.N(), forwardDecayWeightUnit; got != want {
+		t.Errorf("totalN mismatch, got=%d, want=%d", got, want)
+	}
+}
+
+func TestForwardDecaySketch_Renormalize(t *testing.T) {
+	const halfLife = time.Second
+	clock := newFakeClock()
+	s := NewForwardDecaySketch[float64](math.Ln2/halfLife.Seconds(), 12, true,
+		WithClock(clock), WithREQSketchOptions(WithDeterministic()))
+	start := s.landmark
+	want := 0.0
+	// the weight grows by 2^100 in total, far beyond the range of int.
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 100; j++ {
+			s.Add(float64(i))
+		}
+		want = want/2 + 100
+		clock.Advance(halfLife)
+	}
+	want /= 2
+	if !s.landmark.After(start) {
+		t.Errorf("landmark must be moved")
+	}
+	if got := s.DecayedCount(); math.Abs(got-want) > want*0.01 {
+		t.Errorf("decayed count mismatch, got=%g, want=%g", got, want)
+	}
+	checkValid(t, s.s)
+	// half of the weight is in the newest second.
+	if got, err := s.Quantile(0.6, QuantileSearchCriteriaInclusive); err != nil || got != 99 {
+		t.Errorf("quantile mismatch, got=%g, err=%v, want=99", got, err)
+	}
+}
+
+func TestForwardDecaySketch_RenormalizeSeed(t *testing.T) {
+	const halfLife = time.Second
+	newSketch := func(clock Clock) *ForwardDecaySketch[float64] {
+		return NewForwardDecaySketch[float64](math.Ln2/halfLife.Seconds(), 12, true,
+			WithClock(clock), WithREQSketchOptions(WithSeed(42)))
+	}
+	clock1, clock2 := newFakeClock(), newFakeClock()
+	s1, s2 := newSketch(clock1), newSketch(clock2)
+	seeds := map[int64]bool{s1.s.Seed(): true}
+	for i := 0; i < 100; i++ {
+		s1.Add(float64(i))
+		s2.Add(float64(i))
+		if got, want := s1.s.Seed(), s2.s.Seed(); got != want {
+			t.Fatalf("seed mismatch for the same seed, i=%d, got=%d, want=%d", i, got, want)
+		}
+		seeds[s1.s.Seed()] = true
+		clock1.Advance(halfLife)
+		clock2.Advance(halfLife)
+	}
+	// the weight grows by 2^16 in 16 seconds, so the sketch must have been
+	// renormalized and reseeded several times.
+	if got, min := len(seeds), 5; got < min {
+		t.Errorf("too few distinct seeds, got=%d, min=%d", got, min)
+	}
+}
+
+func TestForwardDecayRoundingSeed(t *testing.T) {
+	const golden = 0x9e3779b97f4a7c15
+	for _, seed := range []int64{0, 1, 42, -1, math.MaxInt64} {
+		roundingSeed := forwardDecayRoundingSeed(seed)
+		for lgWeight := 0; lgWeight < 64; lgWeight++ {
+			if compactorSeed := int64(uint64(seed) + uint64(lgWeight)*golden); roundingSeed == compactorSeed {
+				t.Errorf("rounding seed must differ from compactor seed, seed=%d, lgWeight=%d", seed, lgWeight)
+			}
+		}
+	}
+}
+
+// weightedRanks returns the fraction of weights of values less than v and
+// the one of values less than or equal to v.
+func weightedRanks(values, weights []float64, v float64) (lt, le float64) {
+	var total float64
+	for i, x := range values {
+		total += weights[i]
+		if x < v {
+			lt += weights[i]
+		}
+		if x <= v {
+			le += weights[i]
+		}
+	}
+	return lt / total, le / total
+}
+
+func TestForwardDecaySketch_PropertyCompareToExact(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		seed := rapid.Int64().Draw(t, "seed")
+		hra := rapid.Bool().Draw(t, "hra")
+		halfLife := time.Duration(rapid.IntRange(1, 60).Draw(t, "halfLifeSeconds")) * time.Second
+		const k = 12
+		lambda := math.Ln2 / halfLife.Seconds()
+		clock := newFakeClock()
+		s := NewForwardDecaySketch[float64](lambda, k, hra,
+			WithClock(clock), WithREQSketchOptions(WithSeed(seed)))
+		rnd := rand.New(rand.NewSource(seed))
+
+		var values []float64
+		var times []time.Time
+		numSteps := 1 + rnd.Intn(50)
+		for i := 0; i < numSteps; i++ {
+			clock.Advance(time.Duration(rnd.Int63n(int64(5 * time.Second))))
+			n := 1 + rnd.Intn(200)
+			// shift values over time so that decay changes quantiles
+			offset := float64(i) / float64(numSteps)
+			for j := 0; j < n; j++ {
+				v := offset + rnd.Float64()
+				s.Add(v)
+				values = append(values, v)
+				times = append(times, clock.Now())
+			}
+		}
+
+		now := clock.Now()
+		weights := make([]float64, len(values))
+		var total float64
+		for i, tm := range times {
+			weights[i] = math.Exp(lambda * tm.Sub(now).Seconds())
+			total += weights[i]
+		}
+		if got := s.DecayedCount(); math.Abs(got-total) > total*0.01+1 {
+			t.Fatalf("decayed count mismatch, got=%g, want=%g", got, total)
+		}
+
+		pValues := []float64{0.01, 0.25, 0.5, 0.75, 0.99}
+		for _, p := range pValues {
+			v, err := s.Quantile(p, QuantileSearchCriteriaInclusive)
+			if err != nil {
+				t.Fatalf("quantile: p=%g, err=%s", p, err)
+			}
+			lt, le := weightedRanks(values, weights, v)
+			margin := reqRelativeRankErrorBound(k, hra, p) + 0.005
+			if p < lt-margin || p > le+margin {
+				t.Fatalf("weighted rank out of range, p=%g, v=%g, rank=[%g, %g], margin=%g", p, v, lt, le, margin)
+			}
+		}
+
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+		for i := 0; i < 10; i++ {
+			v := sorted[rnd.Intn(len(sorted))]
+			got, err := s.Rank(v, QuantileSearchCriteriaInclusive)
+			if err != nil {
+				t.Fatalf("rank: v=%g, err=%s", v, err)
+			}
+			_, want := weightedRanks(values, weights, v)
+			margin := reqRelativeRankErrorBound(k, hra, want) + 0.005
+			if math.Abs(got-want) > margin {
+				t.Fatalf("rank out of range, v=%g, got=%g, want=%g, margin=%g", v, got, want, margin)
+			}
+		}
+	})
+}
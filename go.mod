@@ -4,4 +4,4 @@ go 1.19
 
 require golang.org/x/exp v0.0.0-20221230185412-738e83a70c30
 
-require pgregory.net/rapid v0.5.5 // indirect
+require pgregory.net/rapid v0.5.5
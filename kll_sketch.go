@@ -0,0 +1,308 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// KLLSketch is a quantile sketch with additive rank error, which is described
+// in "Optimal Quantile Approximation in Streams" by Zohar Karnin, Kevin Lang
+// and Edo Liberty. This is a port of KllFloatsSketch in Apache DataSketches
+// except that each level is held in its own itemBuffer.
+type KLLSketch struct {
+	k    int
+	minK int // smallest k of merged sketches, used for error estimation
+
+	// state variables
+
+	n       int
+	minItem float64
+	maxItem float64
+
+	// objects
+
+	sv     *sortedView[float64]
+	levels []*itemBuffer[float64] // levels[h] holds items of weight 1<<h
+	seed   int64
+	random *rand.Rand
+}
+
+// KLLSketchOption configures a KLLSketch.
+type KLLSketchOption func(*kllSketchConfig)
+
+type kllSketchConfig struct {
+	seed int64
+}
+
+// WithKLLSeed makes the random source for compaction derived from seed
+// instead of the current time. Sketches created with the same seed make
+// the same coin flips for the same input.
+func WithKLLSeed(seed int64) KLLSketchOption {
+	return func(c *kllSketchConfig) {
+		c.seed = seed
+	}
+}
+
+const (
+	kllMinK     = 8
+	kllMaxK     = 1<<16 - 1
+	kllMinLevel = 8 // minimum capacity of a level, called m in the paper
+)
+
+// NewKLLSketch creates a KLLSketch.
+// @param k Controls the size and error of the sketch. It must be in the range
+// [8, 65535], inclusive. Value of 200 roughly corresponds to 1.33% normalized
+// rank error at 99% confidence.
+func NewKLLSketch(k int, opts ...KLLSketchOption) *KLLSketch {
+	if k < kllMinK || k > kllMaxK {
+		panic("k must be in the range [8, 65535]")
+	}
+	cfg := kllSketchConfig{seed: time.Now().UnixNano()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	s := &KLLSketch{
+		k:       k,
+		minK:    k,
+		minItem: math.NaN(),
+		maxItem: math.NaN(),
+		seed:    cfg.seed,
+		random:  rand.New(rand.NewSource(cfg.seed)),
+	}
+	s.addEmptyTopLevel()
+	return s
+}
+
+func (s *KLLSketch) Add(item float64) {
+	if math.IsNaN(item) {
+		panic("cannot add NaN")
+	}
+	if s.empty() {
+		s.minItem = item
+		s.maxItem = item
+	} else {
+		if item < s.minItem {
+			s.minItem = item
+		}
+		if item > s.maxItem {
+			s.maxItem = item
+		}
+	}
+	if s.numRetained() >= s.totalCapacity() {
+		s.compactOnce()
+	}
+	s.levels[0].Append(item)
+	s.n++
+	s.sv = nil
+}
+
+// Merge merges other into s. The normalized rank error of s becomes the
+// one for the smaller k of s and other.
+func (s *KLLSketch) Merge(other *KLLSketch) error {
+	if other == nil || other.empty() {
+		return nil
+	}
+
+	// copy level 0 first in case other == s
+	level0 := other.levels[0].clone()
+	upper := make([]*itemBuffer[float64], len(other.levels)-1)
+	for h := range upper {
+		upper[h] = other.levels[h+1].clone()
+	}
+	otherMinItem, otherMaxItem := other.minItem, other.maxItem
+	otherMinK := other.minK
+	otherUpperN := other.n - level0.count
+
+	for i := 0; i < level0.count; i++ {
+		s.Add(level0.arr[i])
+	}
+	for i, buf := range upper {
+		h := i + 1
+		for s.numLevels() <= h {
+			s.addEmptyTopLevel()
+		}
+		s.levels[h].mergeSortIn(buf)
+	}
+	s.n += otherUpperN
+	if math.IsNaN(s.minItem) || otherMinItem < s.minItem {
+		s.minItem = otherMinItem
+	}
+	if math.IsNaN(s.maxItem) || otherMaxItem > s.maxItem {
+		s.maxItem = otherMaxItem
+	}
+	if otherMinK < s.minK {
+		s.minK = otherMinK
+	}
+	for s.numRetained() > s.totalCapacity() {
+		s.compactOnce()
+	}
+	s.sv = nil
+	return nil
+}
+
+// Quantile returns the approximate item at the normalized rank with the
+// same search criteria semantics as REQSketch.Quantile.
+func (s *KLLSketch) Quantile(normRank float64, searchCrit QuantileSearchCriteria) (float64, error) {
+	if s.empty() {
+		return 0, errEmptySketch
+	}
+	if err := checkNormalizedRankBounds(normRank); err != nil {
+		return 0, err
+	}
+	s.refreshSortedView()
+	return s.sv.Quantile(normRank, searchCrit)
+}
+
+// Rank returns the approximate normalized rank of item with the same
+// search criteria semantics as REQSketch.Rank.
+func (s *KLLSketch) Rank(item float64, searchCrit QuantileSearchCriteria) (float64, error) {
+	if s.empty() {
+		return 0, errEmptySketch
+	}
+	s.refreshSortedView()
+	return s.sv.Rank(item, searchCrit)
+}
+
+// N returns the number of items added to the sketch, including those of
+// merged sketches.
+func (s *KLLSketch) N() int { return s.n }
+
+// Min returns the minimum item added to the sketch.
+func (s *KLLSketch) Min() (float64, error) {
+	if s.empty() {
+		return 0, errEmptySketch
+	}
+	return s.minItem, nil
+}
+
+// Max returns the maximum item added to the sketch.
+func (s *KLLSketch) Max() (float64, error) {
+	if s.empty() {
+		return 0, errEmptySketch
+	}
+	return s.maxItem, nil
+}
+
+// Reset removes all items while keeping k and the seed, so a seeded
+// sketch makes the same coin flips again.
+func (s *KLLSketch) Reset() {
+	*s = *NewKLLSketch(s.k, WithKLLSeed(s.seed))
+}
+
+// NormalizedRankError returns the normalized rank error of the sketch at
+// 99% confidence. If pmf is true, it returns the error for PMF, otherwise
+// the error for single rank queries.
+func (s *KLLSketch) NormalizedRankError(pmf bool) float64 {
+	return KLLNormalizedRankError(s.minK, pmf)
+}
+
+// KLLNormalizedRankError returns the normalized rank error of a sketch with
+// parameter k at 99% confidence. If pmf is true, it returns the error for
+// PMF, otherwise the error for single rank queries.
+// The constants were derived empirically in Apache DataSketches.
+func KLLNormalizedRankError(k int, pmf bool) float64 {
+	if pmf {
+		return 2.446 / math.Pow(float64(k), 0.9433)
+	}
+	return 2.296 / math.Pow(float64(k), 0.9723)
+}
+
+func (s *KLLSketch) refreshSortedView() {
+	if s.sv != nil {
+		return
+	}
+	retained := s.numRetained()
+	v := &sortedView[float64]{
+		quantiles:  make([]float64, retained),
+		cumWeights: make([]int, retained),
+		totalN:     s.n,
+	}
+	count := 0
+	for h, buf := range s.levels {
+		v.mergeSortIn(buf, 1<<h, count, false)
+		count += buf.count
+	}
+	v.createCumulativeNativeRanks()
+	s.sv = v
+}
+
+func (s *KLLSketch) empty() bool { return s.n == 0 }
+
+func (s *KLLSketch) numLevels() int { return len(s.levels) }
+
+func (s *KLLSketch) numRetained() int {
+	count := 0
+	for _, buf := range s.levels {
+		count += buf.count
+	}
+	return count
+}
+
+func (s *KLLSketch) totalCapacity() int {
+	total := 0
+	for h := range s.levels {
+		total += s.levelCapacity(h)
+	}
+	return total
+}
+
+// levelCapacity returns the capacity of level h, which is about
+// k*(2/3)^depth where depth is the distance from the top level.
+func (s *KLLSketch) levelCapacity(h int) int {
+	depth := s.numLevels() - h - 1
+	capacity := kllIntCapAux(s.k, depth)
+	if capacity < kllMinLevel {
+		return kllMinLevel
+	}
+	return capacity
+}
+
+func kllIntCapAux(k, depth int) int {
+	if depth <= 30 {
+		return kllIntCapAuxAux(k, depth)
+	}
+	half := depth / 2
+	rest := depth - half
+	return kllIntCapAuxAux(kllIntCapAuxAux(k, half), rest)
+}
+
+// kllIntCapAuxAux returns round(k*(2/3)^depth) for depth <= 30.
+func kllIntCapAuxAux(k, depth int) int {
+	twoK := int64(k) << 1
+	tmp := (twoK << depth) / kllPowerOfThree(depth)
+	return int((tmp + 1) >> 1)
+}
+
+func kllPowerOfThree(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 3
+	}
+	return p
+}
+
+func (s *KLLSketch) addEmptyTopLevel() {
+	s.levels = append(s.levels, newItemBuffer[float64](s.k, s.k, false, nil))
+}
+
+// compactOnce compacts the lowest level which is at its capacity.
+func (s *KLLSketch) compactOnce() {
+	h := 0
+	for ; h < s.numLevels(); h++ {
+		if s.levels[h].count >= s.levelCapacity(h) {
+			break
+		}
+	}
+	if h >= s.numLevels()-1 {
+		s.addEmptyTopLevel()
+	}
+
+	buf := s.levels[h]
+	buf.Sort()
+	// if the population is odd, the first item stays at this level
+	start := buf.count & 1
+	promoted := buf.getEvensOrOdds(start, buf.count, s.random.Float64() < 0.5)
+	buf.trimCount(start)
+	s.levels[h+1].mergeSortIn(promoted)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/exp/slices"
+	"pgregory.net/rapid"
+)
+
+func TestKLLSketch(t *testing.T) {
+	s := NewKLLSketch(200)
+	for _, v := range []float64{12, 6, 10, 1} {
+		s.Add(v)
+	}
+	testCases := []struct {
+		searchCrit QuantileSearchCriteria
+		pValues    []float64
+		want       []float64
+	}{
+		{
+			searchCrit: QuantileSearchCriteriaInclusive,
+			pValues:    []float64{0, 0.25, 0.5, 0.75, 1},
+			want:       []float64{1, 1, 6, 10, 12},
+		},
+		{
+			searchCrit: QuantileSearchCriteriaExclusive,
+			pValues:    []float64{0, 0.25, 0.5, 0.75, 1},
+			want:       []float64{1, 6, 10, 12, 12},
+		},
+	}
+	for caseIdx, tc := range testCases {
+		got := make([]float64, len(tc.pValues))
+		for i, p := range tc.pValues {
+			v, err := s.Quantile(p, tc.searchCrit)
+			if err != nil {
+				t.Fatalf("quantile: case=%d, p=%g, err=%s", caseIdx, p, err)
+			}
+			got[i] = v
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("result mismatch, case=%d, got=%v, want=%v", caseIdx, got, tc.want)
+		}
+	}
+
+	if got, err := s.Rank(6, QuantileSearchCriteriaInclusive); err != nil || got != 0.5 {
+		t.Errorf("rank mismatch, got=%g, err=%v, want=0.5", got, err)
+	}
+}
+
+func TestKLLSketch_LevelCapacity(t *testing.T) {
+	s := NewKLLSketch(200)
+	for len(s.levels) < 5 {
+		s.addEmptyTopLevel()
+	}
+	want := []int{40, 59, 89, 133, 200}
+	got := make([]int, len(s.levels))
+	for h := range s.levels {
+		got[h] = s.levelCapacity(h)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("capacity mismatch, got=%v, want=%v", got, want)
+	}
+}
+
+func TestKLLNormalizedRankError(t *testing.T) {
+	const tolerance = 1e-4
+	testCases := []struct {
+		k    int
+		pmf  bool
+		want float64
+	}{
+		{k: 200, pmf: false, want: 0.0133},
+		{k: 200, pmf: true, want: 0.0165},
+		{k: 8, pmf: false, want: 0.3041},
+	}
+	for _, tc := range testCases {
+		if got := KLLNormalizedRankError(tc.k, tc.pmf); math.Abs(got-tc.want) > tolerance {
+			t.Errorf("error mismatch, k=%d, pmf=%v, got=%.4f, want=%.4f", tc.k, tc.pmf, got, tc.want)
+		}
+	}
+}
+
+func TestKLLSketch_MergeDifferentK(t *testing.T) {
+	s1 := NewKLLSketch(200)
+	s2 := NewKLLSketch(100)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		s1.Add(rnd.Float64())
+		s2.Add(rnd.Float64())
+	}
+	if err := s1.Merge(s2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s1.n, 20000; got != want {
+		t.Errorf("n mismatch, got=%d, want=%d", got, want)
+	}
+	if got, want := s1.NormalizedRankError(false), KLLNormalizedRankError(100, false); got != want {
+		t.Errorf("normalized rank error mismatch, got=%g, want=%g", got, want)
+	}
+}
+
+func TestKLLSketch_Seed(t *testing.T) {
+	s1 := NewKLLSketch(8, WithKLLSeed(42))
+	s2 := NewKLLSketch(8, WithKLLSeed(42))
+	for i := 0; i < 1000; i++ {
+		s1.Add(float64(i))
+		s2.Add(float64(i))
+	}
+	if got, want := s1.N(), 1000; got != want {
+		t.Errorf("n mismatch, got=%d, want=%d", got, want)
+	}
+	for _, p := range []float64{0, 0.25, 0.5, 0.75, 1} {
+		v1, err := s1.Quantile(p, QuantileSearchCriteriaInclusive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v2, err := s2.Quantile(p, QuantileSearchCriteriaInclusive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v1 != v2 {
+			t.Errorf("quantile mismatch for same seed, p=%g, got=%g, want=%g", p, v1, v2)
+		}
+	}
+
+	s1.Reset()
+	if got, want := s1.N(), 0; got != want {
+		t.Errorf("n mismatch after reset, got=%d, want=%d", got, want)
+	}
+	for i := 0; i < 1000; i++ {
+		s1.Add(float64(i))
+	}
+	if !slices.EqualFunc(s1.levels, s2.levels, func(a, b *itemBuffer[float64]) bool {
+		return slices.Equal(a.items(), b.items())
+	}) {
+		t.Errorf("levels mismatch after reset with the same seed")
+	}
+}
+
+func TestKLLSketch_PropertyWeights(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		seed := rapid.Int64().Draw(t, "seed")
+		k := rapid.IntRange(kllMinK, 300).Draw(t, "k")
+		s := NewKLLSketch(k, WithKLLSeed(seed))
+		rnd := rand.New(rand.NewSource(seed))
+		n := rnd.Intn(20000)
+		for i := 0; i < n; i++ {
+			s.Add(rnd.Float64())
+		}
+		weight := 0
+		for h, buf := range s.levels {
+			weight += buf.count << h
+		}
+		if weight != n {
+			t.Fatalf("total weight mismatch, got=%d, want=%d", weight, n)
+		}
+		if got, max := s.numRetained(), s.totalCapacity(); got > max {
+			t.Fatalf("too many retained items, got=%d, max=%d", got, max)
+		}
+	})
+}
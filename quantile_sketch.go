@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// QuantileSketch is the interface shared by the quantile estimators in this
+// package, so that callers can switch algorithms without changing code.
+type QuantileSketch interface {
+	// Add adds a value.
+	Add(v float64)
+	// Quantile returns the approximate value at the normalized rank p.
+	Quantile(p float64) (float64, error)
+	// Rank returns the approximate normalized rank of v, that is, the
+	// fraction of values less than or equal to v.
+	Rank(v float64) (float64, error)
+	// Count returns the number of values added.
+	Count() int
+	// Min returns the minimum value added.
+	Min() (float64, error)
+	// Max returns the maximum value added.
+	Max() (float64, error)
+	// Merge merges other into the sketch. other must be of the same
+	// type as the sketch.
+	Merge(other QuantileSketch) error
+	// Reset removes all values.
+	Reset()
+}
+
+var errIncompatibleSketch = errors.New("cannot merge sketches of different types")
+
+type reqSketchAdapter struct {
+	s          *REQSketch[float64]
+	searchCrit QuantileSearchCriteria
+}
+
+// AdaptREQSketch returns a QuantileSketch backed by s. searchCrit is used
+// for both Quantile and Rank.
+func AdaptREQSketch(s *REQSketch[float64], searchCrit QuantileSearchCriteria) QuantileSketch {
+	return &reqSketchAdapter{s: s, searchCrit: searchCrit}
+}
+
+func (a *reqSketchAdapter) Add(v float64) { a.s.Add(v) }
+
+func (a *reqSketchAdapter) Quantile(p float64) (float64, error) {
+	return a.s.Quantile(p, a.searchCrit)
+}
+
+func (a *reqSketchAdapter) Rank(v float64) (float64, error) {
+	return a.s.Rank(v, a.searchCrit)
+}
+
+func (a *reqSketchAdapter) Count() int            { return a.s.N() }
+func (a *reqSketchAdapter) Min() (float64, error) { return a.s.Min() }
+func (a *reqSketchAdapter) Max() (float64, error) { return a.s.Max() }
+func (a *reqSketchAdapter) Reset()                { a.s.Reset() }
+
+// Validate checks the internal invariants of the underlying REQSketch.
+func (a *reqSketchAdapter) Validate() error { return a.s.Validate() }
+
+func (a *reqSketchAdapter) Merge(other QuantileSketch) error {
+	o, ok := other.(*reqSketchAdapter)
+	if !ok {
+		return errIncompatibleSketch
+	}
+	return a.s.Merge(o.s)
+}
+
+type kllSketchAdapter struct {
+	s          *KLLSketch
+	searchCrit QuantileSearchCriteria
+}
+
+// AdaptKLLSketch returns a QuantileSketch backed by s. searchCrit is used
+// for both Quantile and Rank.
+func AdaptKLLSketch(s *KLLSketch, searchCrit QuantileSearchCriteria) QuantileSketch {
+	return &kllSketchAdapter{s: s, searchCrit: searchCrit}
+}
+
+func (a *kllSketchAdapter) Add(v float64) { a.s.Add(v) }
+
+func (a *kllSketchAdapter) Quantile(p float64) (float64, error) {
+	return a.s.Quantile(p, a.searchCrit)
+}
+
+func (a *kllSketchAdapter) Rank(v float64) (float64, error) {
+	return a.s.Rank(v, a.searchCrit)
+}
+
+func (a *kllSketchAdapter) Count() int            { return a.s.N() }
+func (a *kllSketchAdapter) Min() (float64, error) { return a.s.Min() }
+func (a *kllSketchAdapter) Max() (float64, error) { return a.s.Max() }
+func (a *kllSketchAdapter) Reset()                { a.s.Reset() }
+
+func (a *kllSketchAdapter) Merge(other QuantileSketch) error {
+	o, ok := other.(*kllSketchAdapter)
+	if !ok {
+		return errIncompatibleSketch
+	}
+	return a.s.Merge(o.s)
+}
+
+type tdigestAdapter struct {
+	d *TDigest
+}
+
+// AdaptTDigest returns a QuantileSketch backed by d.
+func AdaptTDigest(d *TDigest) QuantileSketch {
+	return &tdigestAdapter{d: d}
+}
+
+func (a *tdigestAdapter) Add(v float64)                       { a.d.Add(v) }
+func (a *tdigestAdapter) Quantile(p float64) (float64, error) { return a.d.Quantile(p) }
+func (a *tdigestAdapter) Rank(v float64) (float64, error)     { return a.d.Rank(v) }
+func (a *tdigestAdapter) Count() int                          { return a.d.Count() }
+func (a *tdigestAdapter) Min() (float64, error)               { return a.d.Min() }
+func (a *tdigestAdapter) Max() (float64, error)               { return a.d.Max() }
+func (a *tdigestAdapter) Reset()                              { a.d.Reset() }
+
+func (a *tdigestAdapter) Merge(other QuantileSketch) error {
+	o, ok := other.(*tdigestAdapter)
+	if !ok {
+		return errIncompatibleSketch
+	}
+	a.d.Merge(o.d)
+	return nil
+}
+
+type ddSketchAdapter struct {
+	s *DDSketch
+}
+
+// AdaptDDSketch returns a QuantileSketch backed by s.
+func AdaptDDSketch(s *DDSketch) QuantileSketch {
+	return &ddSketchAdapter{s: s}
+}
+
+func (a *ddSketchAdapter) Add(v float64)                       { a.s.Add(v) }
+func (a *ddSketchAdapter) Quantile(p float64) (float64, error) { return a.s.Quantile(p) }
+func (a *ddSketchAdapter) Rank(v float64) (float64, error)     { return a.s.Rank(v) }
+func (a *ddSketchAdapter) Count() int                          { return a.s.Count() }
+func (a *ddSketchAdapter) Min() (float64, error)               { return a.s.Min() }
+func (a *ddSketchAdapter) Max() (float64, error)               { return a.s.Max() }
+func (a *ddSketchAdapter) Reset()                              { a.s.Reset() }
+
+func (a *ddSketchAdapter) Merge(other QuantileSketch) error {
+	o, ok := other.(*ddSketchAdapter)
+	if !ok {
+		return errIncompatibleSketch
+	}
+	return a.s.Merge(o.s)
+}
+
+type summaryAdapter struct {
+	s *Summary
+}
+
+// AdaptSummary returns a QuantileSketch backed by s.
+func AdaptSummary(s *Summary) QuantileSketch {
+	return &summaryAdapter{s: s}
+}
+
+func (a *summaryAdapter) Add(v float64) { a.s.Add(v) }
+
+func (a *summaryAdapter) Quantile(p float64) (float64, error) {
+	if err := checkNormalizedRankBounds(p); err != nil {
+		return 0, err
+	}
+	return a.s.Quantile(p)
+}
+
+// Rank returns the estimated fraction of values less than or equal to v.
+func (a *summaryAdapter) Rank(v float64) (float64, error) {
+	if a.s.Count() == 0 {
+		return 0, errNoValueAdded
+	}
+	if math.IsNaN(v) {
+		return 0, errNaNRankItem
+	}
+	if math.IsInf(v, 1) {
+		return 1, nil
+	}
+	// The values less than or equal to v are the ones less than the next
+	// float64 value.
+	next := math.Nextafter(v, math.Inf(1))
+	return float64(a.s.EstimatedRank(next)-1) / float64(a.s.Count()), nil
+}
+
+func (a *summaryAdapter) Count() int            { return a.s.Count() }
+func (a *summaryAdapter) Min() (float64, error) { return a.s.Min() }
+func (a *summaryAdapter) Max() (float64, error) { return a.s.Max() }
+func (a *summaryAdapter) Reset()                { a.s.Reset() }
+
+// Validate checks the internal invariants of the underlying Summary.
+func (a *summaryAdapter) Validate() error { return a.s.Validate() }
+
+func (a *summaryAdapter) Merge(other QuantileSketch) error {
+	o, ok := other.(*summaryAdapter)
+	if !ok {
+		return errIncompatibleSketch
+	}
+	merged, err := a.s.Combine(o.s)
+	if err != nil {
+		return err
+	}
+	*a.s = *merged
+	return nil
+}
+
+type summaryNaiveImplAdapter struct {
+	s *SummaryNaiveImpl
+}
+
+// AdaptSummaryNaiveImpl returns a QuantileSketch backed by s.
+func AdaptSummaryNaiveImpl(s *SummaryNaiveImpl) QuantileSketch {
+	return &summaryNaiveImplAdapter{s: s}
+}
+
+func (a *summaryNaiveImplAdapter) Add(v float64) { a.s.Add(v) }
+
+func (a *summaryNaiveImplAdapter) Quantile(p float64) (float64, error) {
+	if err := checkNormalizedRankBounds(p); err != nil {
+		return 0, err
+	}
+	return a.s.Quantile(p)
+}
+
+// Rank returns the fraction of values less than or equal to v.
+func (a *summaryNaiveImplAdapter) Rank(v float64) (float64, error) {
+	if len(a.s.values) == 0 {
+		return 0, errNoValueAdded
+	}
+	if math.IsNaN(v) {
+		return 0, errNaNRankItem
+	}
+	i := sort.Search(len(a.s.values), func(i int) bool {
+		return a.s.values[i] > v
+	})
+	return float64(i) / float64(len(a.s.values)), nil
+}
+
+func (a *summaryNaiveImplAdapter) Count() int            { return a.s.Count() }
+func (a *summaryNaiveImplAdapter) Min() (float64, error) { return a.s.Min() }
+func (a *summaryNaiveImplAdapter) Max() (float64, error) { return a.s.Max() }
+func (a *summaryNaiveImplAdapter) Reset()                { a.s.Reset() }
+
+func (a *summaryNaiveImplAdapter) Merge(other QuantileSketch) error {
+	o, ok := other.(*summaryNaiveImplAdapter)
+	if !ok {
+		return errIncompatibleSketch
+	}
+	*a.s = *a.s.Combine(o.s)
+	return nil
+}
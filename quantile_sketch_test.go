@@ -0,0 +1,510 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"pgregory.net/rapid"
+)
+
+type quantileSketchTestCase struct {
+	name string
+	// newSketch returns a new sketch. Randomized sketches must be seeded
+	// with seed so that failures found by rapid can be reproduced.
+	newSketch func(seed int64) QuantileSketch
+	// rankErrorBound returns the allowed normalized rank error at the
+	// normalized rank p.
+	rankErrorBound func(p float64) float64
+	// relativeValueError is the allowed relative error of values. If it is
+	// positive, quantiles are checked by values instead of ranks.
+	relativeValueError float64
+	mergeable          bool
+	// exclusive is true if Rank counts values strictly less than v.
+	exclusive bool
+	// addWeighted adds v with weight w to s. It is nil if the sketch does
+	// not support weighted values.
+	addWeighted func(s QuantileSketch, v float64, w int)
+}
+
+var quantileSketchTestCases = []quantileSketchTestCase{
+	{
+		name: "SummaryNaiveImpl",
+		newSketch: func(seed int64) QuantileSketch {
+			return AdaptSummaryNaiveImpl(&SummaryNaiveImpl{})
+		},
+		rankErrorBound: func(p float64) float64 { return 0 },
+		mergeable:      true,
+	},
+	{
+		name: "Summary",
+		newSketch: func(seed int64) QuantileSketch {
+			return AdaptSummary(NewSummary(0.01))
+		},
+		rankErrorBound: func(p float64) float64 { return 0.01 },
+		mergeable:      true,
+	},
+	{
+		name: "SummaryBandCompression",
+		newSketch: func(seed int64) QuantileSketch {
+			return AdaptSummary(NewSummary(0.01, WithBandCompression()))
+		},
+		rankErrorBound: func(p float64) float64 { return 0.01 },
+		mergeable:      true,
+	},
+	{
+		name: "KLLSketch",
+		newSketch: func(seed int64) QuantileSketch {
+			return AdaptKLLSketch(NewKLLSketch(200, WithKLLSeed(seed)), QuantileSearchCriteriaInclusive)
+		},
+		rankErrorBound: func(p float64) float64 { return KLLNormalizedRankError(200, false) },
+		mergeable:      true,
+	},
+	{
+		name: "DDSketch",
+		newSketch: func(seed int64) QuantileSketch {
+			return AdaptDDSketch(NewDDSketch(0.01, DDSketchDenseStore()))
+		},
+		relativeValueError: 0.01,
+		mergeable:          true,
+	},
+	{
+		name: "TDigestK1",
+		newSketch: func(seed int64) QuantileSketch {
+			return AdaptTDigest(NewTDigest(100, TDigestScaleK1))
+		},
+		rankErrorBound: tdigestRankErrorBound,
+		mergeable:      true,
+	},
+	{
+		name: "TDigestK2",
+		newSketch: func(seed int64) QuantileSketch {
+			return AdaptTDigest(NewTDigest(100, TDigestScaleK2))
+		},
+		rankErrorBound: tdigestRankErrorBound,
+		mergeable:      true,
+	},
+	{
+		name: "REQSketchHRA",
+		newSketch: func(seed int64) QuantileSketch {
+			return AdaptREQSketch(NewREQSketch[float64](12, true, WithSeed(seed)), QuantileSearchCriteriaInclusive)
+		},
+		rankErrorBound: func(p float64) float64 { return reqRelativeRankErrorBound(12, true, p) },
+		mergeable:      true,
+		addWeighted:    addWeightedREQSketch,
+	},
+	{
+		name: "REQSketchHRAExclusive",
+		newSketch: func(seed int64) QuantileSketch {
+			return AdaptREQSketch(NewREQSketch[float64](12, true, WithSeed(seed)), QuantileSearchCriteriaExclusive)
+		},
+		rankErrorBound: func(p float64) float64 { return reqRelativeRankErrorBound(12, true, p) },
+		mergeable:      true,
+		exclusive:      true,
+		addWeighted:    addWeightedREQSketch,
+	},
+	{
+		name: "REQSketchK1024HRAExclusive",
+		newSketch: func(seed int64) QuantileSketch {
+			return AdaptREQSketch(NewREQSketch[float64](1024, true, WithSeed(seed)), QuantileSearchCriteriaExclusive)
+		},
+		rankErrorBound: func(p float64) float64 { return 0.01 },
+		mergeable:      true,
+		exclusive:      true,
+		addWeighted:    addWeightedREQSketch,
+	},
+	{
+		name: "REQSketchLRA",
+		newSketch: func(seed int64) QuantileSketch {
+			return AdaptREQSketch(NewREQSketch[float64](12, false, WithSeed(seed)), QuantileSearchCriteriaInclusive)
+		},
+		rankErrorBound: func(p float64) float64 { return reqRelativeRankErrorBound(12, false, p) },
+		mergeable:      true,
+		addWeighted:    addWeightedREQSketch,
+	},
+}
+
+func addWeightedREQSketch(s QuantileSketch, v float64, w int) {
+	s.(*reqSketchAdapter).s.AddWeighted(v, w)
+}
+
+// checkQuantileSketchAgainstNaive checks quantiles and ranks of s are within
+// rankErrorBound of those of sRef. All values added must be distinct.
+func checkQuantileSketchAgainstNaive(t rapid.TB, s QuantileSketch, sRef *SummaryNaiveImpl, tc quantileSketchTestCase) {
+	t.Helper()
+	n := len(sRef.values)
+	if got, want := s.Count(), n; got != want {
+		t.Fatalf("count mismatch, got=%d, want=%d", got, want)
+	}
+
+	pValues := []float64{0, 0.25, 0.5, 0.75, 0.99, 0.999, 0.9999, 1}
+	if tc.relativeValueError > 0 {
+		checkRelativeValueError(t, s, sRef, tc.relativeValueError, pValues)
+		return
+	}
+	rankErrorBound := tc.rankErrorBound
+	for _, p := range pValues {
+		v, err := s.Quantile(p)
+		if err != nil {
+			t.Fatalf("quantile: p=%g, err=%s", p, err)
+		}
+		// number of values less than v
+		gotRank := sRef.Rank(v) - 1
+		wantRank := minInt(int(p*float64(n)), n-1)
+		margin := int(math.Ceil(rankErrorBound(p)*float64(n))) + 1
+		if gotRank < wantRank-margin || gotRank > wantRank+margin {
+			t.Fatalf("quantile rank out of range, p=%g, v=%g, gotRank=%d, wantRank=%d, margin=%d",
+				p, v, gotRank, wantRank, margin)
+		}
+	}
+
+	for _, p := range pValues {
+		v := sRef.values[minInt(int(p*float64(n)), n-1)]
+		got, err := s.Rank(v)
+		if err != nil {
+			t.Fatalf("rank: v=%g, err=%s", v, err)
+		}
+		// fraction of values less than (or equal to, unless exclusive) v
+		want := float64(sRef.Rank(v)) / float64(n)
+		if tc.exclusive {
+			want = float64(sRef.Rank(v)-1) / float64(n)
+		}
+		margin := rankErrorBound(want) + 1/float64(n)
+		if math.Abs(got-want) > margin {
+			t.Fatalf("rank out of range, v=%g, got=%g, want=%g, margin=%g", v, got, want, margin)
+		}
+	}
+}
+
+func TestQuantileSketch_RankEqualValues(t *testing.T) {
+	for _, tc := range quantileSketchTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := tc.newSketch(0)
+			for _, v := range []float64{1, 2, 2, 2, 3} {
+				s.Add(v)
+			}
+			testCases := []struct {
+				v             float64
+				want          float64
+				wantExclusive float64
+			}{
+				{v: 0, want: 0, wantExclusive: 0},
+				{v: 1, want: 0.2, wantExclusive: 0},
+				{v: 2, want: 0.8, wantExclusive: 0.2},
+				{v: 3, want: 1, wantExclusive: 0.8},
+				{v: math.Inf(1), want: 1, wantExclusive: 1},
+			}
+			for _, c := range testCases {
+				got, err := s.Rank(c.v)
+				if err != nil {
+					t.Fatalf("rank: v=%g, err=%s", c.v, err)
+				}
+				want := c.want
+				if tc.exclusive {
+					want = c.wantExclusive
+				}
+				if got != want {
+					t.Errorf("rank mismatch, v=%g, got=%g, want=%g", c.v, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestQuantileSketch_PropertyCompareToNaive(t *testing.T) {
+	for _, tc := range quantileSketchTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rapid.Check(t, func(t *rapid.T) {
+				seed := rapid.Int64().Draw(t, "seed")
+				s := tc.newSketch(seed)
+				sRef := &SummaryNaiveImpl{}
+				rnd := rand.New(rand.NewSource(seed))
+				n := 100 + rnd.Intn(5000)
+				for i := 0; i < n; i++ {
+					v := rnd.Float64()
+					s.Add(v)
+					checkValidSketch(t, s)
+					sRef.Add(v)
+				}
+				checkQuantileSketchAgainstNaive(t, s, sRef, tc)
+			})
+		})
+	}
+}
+
+func TestQuantileSketch_PropertyMergeCompareToNaive(t *testing.T) {
+	for _, tc := range quantileSketchTestCases {
+		if !tc.mergeable {
+			continue
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			rapid.Check(t, func(t *rapid.T) {
+				seed := rapid.Int64().Draw(t, "seed")
+				s := tc.newSketch(seed)
+				sRef := &SummaryNaiveImpl{}
+				rnd := rand.New(rand.NewSource(seed))
+				numSketches := 1 + rnd.Intn(8)
+				for i := 0; i < numSketches; i++ {
+					s2 := tc.newSketch(rnd.Int63())
+					n := rnd.Intn(2000)
+					for j := 0; j < n; j++ {
+						v := rnd.Float64()
+						s2.Add(v)
+						checkValidSketch(t, s2)
+						sRef.Add(v)
+					}
+					if err := s.Merge(s2); err != nil {
+						t.Fatalf("merge: err=%s", err)
+					}
+					checkValidSketch(t, s)
+				}
+				if len(sRef.values) == 0 {
+					if got := s.Count(); got != 0 {
+						t.Fatalf("count mismatch, got=%d, want=0", got)
+					}
+					return
+				}
+				checkQuantileSketchAgainstNaive(t, s, sRef, tc)
+			})
+		})
+	}
+}
+
+func TestQuantileSketch_CompareToNaive(t *testing.T) {
+	for _, tc := range quantileSketchTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := tc.newSketch(0)
+			sRef := &SummaryNaiveImpl{}
+			for _, v := range []float64{12, 6, 10, 1} {
+				s.Add(v)
+				sRef.Add(v)
+			}
+			checkQuantileSketchAgainstNaive(t, s, sRef, tc)
+		})
+	}
+}
+
+func TestQuantileSketch_CompareToNaiveRandom(t *testing.T) {
+	var seed int64
+	seedEnv := os.Getenv("SEED")
+	if seedEnv != "" {
+		var err error
+		seed, err = strconv.ParseInt(seedEnv, 10, 64)
+		if err != nil {
+			t.Fatalf("environment variable SEED must be an int64 value, got=%q", seedEnv)
+		}
+	} else {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("seed=%d", seed)
+
+	for _, tc := range quantileSketchTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := tc.newSketch(seed)
+			sRef := &SummaryNaiveImpl{}
+			rnd := rand.New(rand.NewSource(seed))
+			n := 100 + rnd.Intn(1000)
+			for i := 0; i < n; i++ {
+				v := rnd.Float64()
+				s.Add(v)
+				sRef.Add(v)
+			}
+			checkQuantileSketchAgainstNaive(t, s, sRef, tc)
+		})
+	}
+}
+
+func TestQuantileSketch_PropertyRankCompareToNaive(t *testing.T) {
+	for _, tc := range quantileSketchTestCases {
+		if tc.relativeValueError > 0 {
+			continue
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			rapid.Check(t, func(t *rapid.T) {
+				seed := rapid.Int64().Draw(t, "seed")
+				s := tc.newSketch(seed)
+				sRef := &SummaryNaiveImpl{}
+				rnd := rand.New(rand.NewSource(seed))
+				n := 100 + rnd.Intn(10000)
+				for i := 0; i < n; i++ {
+					v := rnd.Float64()
+					s.Add(v)
+					sRef.Add(v)
+				}
+				checkValidSketch(t, s)
+
+				for i := 0; i < 10; i++ {
+					v := rnd.Float64()
+					got, err := s.Rank(v)
+					if err != nil {
+						t.Fatalf("rank: v=%g, err=%s", v, err)
+					}
+					// fraction of values less than (or equal to, unless
+					// exclusive) v
+					want := float64(sRef.Rank(math.Nextafter(v, math.Inf(1)))-1) / float64(n)
+					if tc.exclusive {
+						want = float64(sRef.Rank(v)-1) / float64(n)
+					}
+					margin := tc.rankErrorBound(want) + 1/float64(n)
+					if math.Abs(got-want) > margin {
+						t.Fatalf("rank out of range, v=%g, got=%g, want=%g, margin=%g", v, got, want, margin)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestQuantileSketch_PropertyAddWeightedCompareToNaive(t *testing.T) {
+	for _, tc := range quantileSketchTestCases {
+		if tc.addWeighted == nil {
+			continue
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			rapid.Check(t, func(t *rapid.T) {
+				seed := rapid.Int64().Draw(t, "seed")
+				s := tc.newSketch(seed)
+				sRef := &SummaryNaiveImpl{}
+				rnd := rand.New(rand.NewSource(seed))
+				n := 1 + rnd.Intn(500)
+				for i := 0; i < n; i++ {
+					v := rnd.Float64()
+					w := 1 + rnd.Intn(50)
+					tc.addWeighted(s, v, w)
+					checkValidSketch(t, s)
+					for j := 0; j < w; j++ {
+						sRef.Add(v)
+					}
+				}
+				total := len(sRef.values)
+				if got := s.Count(); got != total {
+					t.Fatalf("count mismatch, got=%d, want=%d", got, total)
+				}
+
+				pValues := []float64{0, 0.25, 0.5, 0.75, 0.99, 0.999, 0.9999, 1}
+				for _, p := range pValues {
+					v, err := s.Quantile(p)
+					if err != nil {
+						t.Fatalf("quantile: p=%g, err=%s", p, err)
+					}
+					// a weighted value spans a range of ranks.
+					gotRankMin := sRef.Rank(v)
+					gotRankMax := sRef.Rank(math.Nextafter(v, math.Inf(1))) - 1
+					wantRank := minInt(int(p*float64(total)+1), total)
+					margin := int(math.Ceil(tc.rankErrorBound(p)*float64(total))) + 1
+					if gotRankMax < wantRank-margin || gotRankMin > wantRank+margin {
+						t.Fatalf("rank out of range, p=%g, v=%g, gotRankMin=%d, gotRankMax=%d, wantRank=%d, margin=%d",
+							p, v, gotRankMin, gotRankMax, wantRank, margin)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestQuantileSketch_MinMaxReset(t *testing.T) {
+	for _, tc := range quantileSketchTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := tc.newSketch(0)
+			if _, err := s.Min(); err == nil {
+				t.Errorf("min of empty sketch must return an error")
+			}
+			if _, err := s.Max(); err == nil {
+				t.Errorf("max of empty sketch must return an error")
+			}
+			for _, v := range []float64{12, 6, 10, 1} {
+				s.Add(v)
+			}
+			if got, err := s.Min(); err != nil || got != 1 {
+				t.Errorf("min mismatch, got=%g, err=%v, want=1", got, err)
+			}
+			if got, err := s.Max(); err != nil || got != 12 {
+				t.Errorf("max mismatch, got=%g, err=%v, want=12", got, err)
+			}
+			s.Reset()
+			if got := s.Count(); got != 0 {
+				t.Errorf("count mismatch after reset, got=%d, want=0", got)
+			}
+			if _, err := s.Quantile(0.5); err == nil {
+				t.Errorf("quantile of reset sketch must return an error")
+			}
+			s.Add(3)
+			if got, err := s.Quantile(0.5); err != nil || got != 3 {
+				t.Errorf("quantile mismatch after reset, got=%g, err=%v, want=3", got, err)
+			}
+		})
+	}
+}
+
+func TestQuantileSketch_QuantileInvalidRank(t *testing.T) {
+	for _, tc := range quantileSketchTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := tc.newSketch(0)
+			for _, v := range []float64{12, 6, 10, 1} {
+				s.Add(v)
+			}
+			for _, p := range []float64{-0.1, 1.1, math.NaN()} {
+				if _, err := s.Quantile(p); err != errNormalizedRankOutOfBounds {
+					t.Errorf("error mismatch, p=%g, got=%v, want=%v", p, err, errNormalizedRankOutOfBounds)
+				}
+			}
+		})
+	}
+}
+
+func TestQuantileSketch_RankNaN(t *testing.T) {
+	for _, tc := range quantileSketchTestCases {
+		s := tc.newSketch(0)
+		s.Add(1)
+		if _, err := s.Rank(math.NaN()); err != errNaNRankItem {
+			t.Errorf("error mismatch, sketch=%s, got=%v, want=%v", tc.name, err, errNaNRankItem)
+		}
+	}
+}
+
+func TestQuantileSketch_MergeIncompatible(t *testing.T) {
+	for _, tc := range quantileSketchTestCases {
+		// other has a dynamic type different from any sketch.
+		other := struct{ QuantileSketch }{tc.newSketch(0)}
+		if err := tc.newSketch(0).Merge(other); err != errIncompatibleSketch {
+			t.Errorf("error mismatch, sketch=%s, got=%v, want=%v", tc.name, err, errIncompatibleSketch)
+		}
+	}
+}
+
+// checkRelativeValueError checks that the quantile at p is within
+// relativeValueError of the value at rank floor(p*(n-1)).
+func checkRelativeValueError(t rapid.TB, s QuantileSketch, sRef *SummaryNaiveImpl, relativeValueError float64, pValues []float64) {
+	t.Helper()
+	n := len(sRef.values)
+	for _, p := range pValues {
+		got, err := s.Quantile(p)
+		if err != nil {
+			t.Fatalf("quantile: p=%g, err=%s", p, err)
+		}
+		want := sRef.values[int(p*float64(n-1))]
+		// a small tolerance for rounding errors
+		if math.Abs(got-want) > relativeValueError*math.Abs(want)*(1+1e-9) {
+			t.Fatalf("quantile out of relative error, p=%g, got=%g, want=%g", p, got, want)
+		}
+	}
+}
+
+// checkValid fails the test if the internal invariants of v are violated.
+func checkValid(t rapid.TB, v interface{ Validate() error }) {
+	t.Helper()
+	if err := v.Validate(); err != nil {
+		t.Fatalf("invalid state: %s", err)
+	}
+}
+
+// checkValidSketch calls checkValid if s has Validate.
+func checkValidSketch(t rapid.TB, s QuantileSketch) {
+	t.Helper()
+	if v, ok := s.(interface{ Validate() error }); ok {
+		checkValid(t, v)
+	}
+}
@@ -6,37 +6,60 @@ import (
 	"math/bits"
 	"math/rand"
 	"sort"
+	"time"
+
+	"golang.org/x/exp/constraints"
+	"golang.org/x/exp/slices"
 )
 
 type QuantileSearchCriteria int
 
 const (
-	QuantileSearchCriteriaInclusive QuantileSearchCriteria = 0
+	// QuantileSearchCriteriaInclusive makes Quantile return the smallest
+	// item whose cumulative weight is greater than or equal to the rank,
+	// and Rank count items less than or equal to the given item.
+	QuantileSearchCriteriaInclusive QuantileSearchCriteria = iota
+	// QuantileSearchCriteriaExclusive makes Quantile return the smallest
+	// item whose cumulative weight is strictly greater than the rank,
+	// and Rank count items strictly less than the given item.
 	QuantileSearchCriteriaExclusive
 )
 
-type REQSketch struct {
-	k   int
-	hra bool
+// REQSketch is a quantile sketch with relative rank error over items of
+// an ordered type T.
+type REQSketch[T constraints.Ordered] struct {
+	k    int
+	hra  bool
+	less func(a, b T) bool // nil means the natural order of T
+
+	// seed from which the random source of each compactor is derived
+	seed int64
+	// if not nil, shared by all compactors instead of the derived ones
+	randSource rand.Source
 
 	// state variables
 
 	totalN  int
-	minItem float64
-	maxItem float64
+	minItem T
+	maxItem T
 
 	// computed from compactors
 
 	retItems   int //number of retained items in the sketch
 	maxNomSize int //sum of nominal capacities of all compactors
 
+	nanPolicy     NaNPolicy
+	numNaNSkipped int
+
+	tracer REQTracer // may be nil
+
 	// objects
 
-	reqSV      *reqSketchSortedView
-	compactors []reqCompactor
+	reqSV      *sortedView[T]
+	compactors []reqCompactor[T]
 }
 
-type reqCompactor struct {
+type reqCompactor[T constraints.Ordered] struct {
 	lgWeight int
 	hra      bool
 
@@ -50,23 +73,25 @@ type reqCompactor struct {
 
 	// objects
 
-	buf    *floatBuffer
+	buf    *itemBuffer[T]
 	random *rand.Rand
 }
 
-type reqSketchSortedView struct {
-	quantiles  []float64
+type sortedView[T constraints.Ordered] struct {
+	quantiles  []T
 	cumWeights []int
 	totalN     int
+	less       func(a, b T) bool // nil means the natural order of T
 }
 
-type floatBuffer struct {
-	arr           []float64
+type itemBuffer[T constraints.Ordered] struct {
+	arr           []T
 	count         int
 	capacity      int
 	delta         int
 	sorted        bool
-	spaceAtBottom bool //tied to hra
+	spaceAtBottom bool              //tied to hra
+	less          func(a, b T) bool // nil means the natural order of T
 }
 
 const (
@@ -74,92 +99,658 @@ const (
 	capacityMultiplier = 2
 
 	initialNumSections = 3
+
+	fixRseFactor = 0.084
 )
 
+var relRseFactor = math.Sqrt(0.0512 / initialNumSections)
+
 var (
 	errEmptySketch               = errors.New("empty sketch")
 	errNormalizedRankOutOfBounds = errors.New("normalized rank must be between 0 and 1")
+	errInvalidSearchCriteria     = errors.New("invalid quantile search criteria")
+	errNaNSplitPoint             = errors.New("split points must not be NaN")
+	errNaNRankItem               = errors.New("item of rank query must not be NaN")
+	errSplitPointsNotIncreasing  = errors.New("split points must be unique and monotonically increasing")
+	errHRAMismatch               = errors.New("both sketches must have the same high rank accuracy setting")
+	errTooFewEvenlySpaced        = errors.New("number of evenly spaced ranks must be at least 2")
 )
 
-// NewREQSketch creates a REQSketch.
+var (
+	// ErrInvalidK is returned when k of REQSketch is not even or not in
+	// the range [4, 1024].
+	ErrInvalidK = errors.New("k must be even and in the range [4, 1024]")
+	// ErrNaNItem is returned when NaN is added to a sketch.
+	ErrNaNItem = errors.New("cannot add NaN")
+	// ErrLessTypeMismatch is returned when the item type of WithLess does
+	// not match the item type of REQSketch.
+	ErrLessTypeMismatch = errors.New("the item type of WithLess does not match the sketch")
+	// ErrInvalidWeight is returned when the weight given to
+	// REQSketch.TryAddWeighted is not positive. TDigest.AddWeighted
+	// panics with it.
+	ErrInvalidWeight = errors.New("weight must be positive")
+)
+
+// NaNPolicy specifies how REQSketch handles NaN items.
+type NaNPolicy int
+
+const (
+	// NaNPolicyPanic makes Add and AddWeighted panic on NaN. TryAdd,
+	// TryAddWeighted and AddAll return ErrNaNItem as with NaNPolicyReject,
+	// since methods returning an error never panic on NaN.
+	NaNPolicyPanic NaNPolicy = iota
+	// NaNPolicyReject makes TryAdd, TryAddWeighted and AddAll return
+	// ErrNaNItem on NaN. Add and AddWeighted still panic since they cannot
+	// return an error.
+	NaNPolicyReject
+	// NaNPolicySkip makes all add methods ignore NaN and count it,
+	// which can be retrieved with NumNaNSkipped.
+	NaNPolicySkip
+)
+
+// REQSketchOption configures a REQSketch.
+type REQSketchOption func(*reqSketchConfig)
+
+type reqSketchConfig struct {
+	seed       int64
+	randSource rand.Source
+	nanPolicy  NaNPolicy
+	less       any // func(a, b T) bool
+	tracer     REQTracer
+}
+
+// reqDeterministicSeed is the seed used by WithDeterministic.
+const reqDeterministicSeed = 1
+
+// WithSeed makes the random sources of the compactors derived from seed.
+// Sketches created with the same seed make the same coin flips for the
+// same input.
+func WithSeed(seed int64) REQSketchOption {
+	return func(c *reqSketchConfig) {
+		c.seed = seed
+		c.randSource = nil
+	}
+}
+
+// withDerivedSeed sets the seed like WithSeed, but keeps the random source
+// given by WithRandSource. It is used by the sketches built on REQSketch to
+// seed each of their sketches differently.
+func withDerivedSeed(seed int64) REQSketchOption {
+	return func(c *reqSketchConfig) {
+		c.seed = seed
+	}
+}
+
+// WithRandSource makes all compactors share src for coin flips.
+// src must not be used concurrently by other goroutines.
+func WithRandSource(src rand.Source) REQSketchOption {
+	return func(c *reqSketchConfig) {
+		c.randSource = src
+	}
+}
+
+// WithDeterministic makes results reproducible across runs by using a
+// fixed seed. It is intended for tests.
+func WithDeterministic() REQSketchOption {
+	return WithSeed(reqDeterministicSeed)
+}
+
+// WithNaNPolicy sets how NaN items are handled.
+func WithNaNPolicy(policy NaNPolicy) REQSketchOption {
+	return func(c *reqSketchConfig) {
+		c.nanPolicy = policy
+	}
+}
+
+// WithLess makes the sketch order items by less instead of the natural
+// order of the item type. The item type of less must be the same as the
+// one of the sketch, otherwise NewREQSketchE returns ErrLessTypeMismatch
+// and NewREQSketch panics.
+func WithLess[T constraints.Ordered](less func(a, b T) bool) REQSketchOption {
+	return func(c *reqSketchConfig) {
+		c.less = less
+	}
+}
+
+// NewREQSketch creates a REQSketch with NaNPolicyPanic. It panics if k is
+// invalid or the item type of WithLess does not match T. Unless WithSeed,
+// WithRandSource or WithDeterministic is given, the seed is taken from the
+// current time, so that sketches make independent coin flips.
 // @param k Controls the size and error of the sketch. It must be even and in the range [4, 1024], inclusive.
 // Value of 12 roughly corresponds to 1% relative error guarantee at 95% confidence.
 // @param highRankAccuracy if true, the high ranks are prioritized for better
 // accuracy. Otherwise the low ranks are prioritized for better accuracy.
-func NewREQSketch(k int, highRankAccuracy bool) *REQSketch {
-	checkK(k)
-	s := &REQSketch{
-		k:       k,
-		hra:     highRankAccuracy,
-		minItem: math.NaN(),
-		maxItem: math.NaN(),
+func NewREQSketch[T constraints.Ordered](k int, highRankAccuracy bool, opts ...REQSketchOption) *REQSketch[T] {
+	if err := checkK(k); err != nil {
+		panic(err)
+	}
+	s, err := newREQSketchWithOptions[T](k, highRankAccuracy, NaNPolicyPanic, opts)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// NewREQSketchE creates a REQSketch with NaNPolicyReject unless
+// WithNaNPolicy is given. It returns ErrInvalidK if k is invalid, or
+// ErrLessTypeMismatch if the item type of WithLess does not match T.
+func NewREQSketchE[T constraints.Ordered](k int, highRankAccuracy bool, opts ...REQSketchOption) (*REQSketch[T], error) {
+	if err := checkK(k); err != nil {
+		return nil, err
+	}
+	return newREQSketchWithOptions[T](k, highRankAccuracy, NaNPolicyReject, opts)
+}
+
+func newREQSketchWithOptions[T constraints.Ordered](k int, highRankAccuracy bool, nanPolicy NaNPolicy, opts []REQSketchOption) (*REQSketch[T], error) {
+	cfg := reqSketchConfig{
+		seed:      time.Now().UnixNano(),
+		nanPolicy: nanPolicy,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	var less func(a, b T) bool
+	if cfg.less != nil {
+		var ok bool
+		if less, ok = cfg.less.(func(a, b T) bool); !ok {
+			return nil, ErrLessTypeMismatch
+		}
+	}
+	return newREQSketch(k, highRankAccuracy, cfg, less), nil
+}
+
+func newREQSketch[T constraints.Ordered](k int, highRankAccuracy bool, cfg reqSketchConfig, less func(a, b T) bool) *REQSketch[T] {
+	s := &REQSketch[T]{
+		k:          k,
+		hra:        highRankAccuracy,
+		less:       less,
+		seed:       cfg.seed,
+		randSource: cfg.randSource,
+		nanPolicy:  cfg.nanPolicy,
+		tracer:     cfg.tracer,
 	}
 	s.grow()
 	return s
 }
 
-func checkK(k int) {
+// Seed returns the seed from which the random sources of the compactors
+// are derived. It is not used if WithRandSource is given.
+func (s *REQSketch[T]) Seed() int64 { return s.seed }
+
+func (s *REQSketch[T]) config() reqSketchConfig {
+	return reqSketchConfig{
+		seed:       s.seed,
+		randSource: s.randSource,
+		nanPolicy:  s.nanPolicy,
+		tracer:     s.tracer,
+	}
+}
+
+// newCompactorRandom returns the random source for the compactor at
+// lgWeight. The seed is derived per level so that levels do not make
+// the same sequence of coin flips.
+func (s *REQSketch[T]) newCompactorRandom(lgWeight int) *rand.Rand {
+	if s.randSource != nil {
+		return rand.New(s.randSource)
+	}
+	const golden = 0x9e3779b97f4a7c15
+	return rand.New(rand.NewSource(int64(uint64(s.seed) + uint64(lgWeight)*golden)))
+}
+
+func checkK(k int) error {
 	if k&1 != 0 || k < 4 || k > 1024 {
-		panic("k must even and in the range [4, 1024]")
+		return ErrInvalidK
+	}
+	return nil
+}
+
+// SetNaNPolicy sets how NaN items are handled.
+func (s *REQSketch[T]) SetNaNPolicy(policy NaNPolicy) {
+	s.nanPolicy = policy
+}
+
+// NumNaNSkipped returns the number of NaN items skipped with
+// NaNPolicySkip.
+func (s *REQSketch[T]) NumNaNSkipped() int { return s.numNaNSkipped }
+
+// Add adds item. It panics if item is NaN unless the NaN policy is
+// NaNPolicySkip.
+func (s *REQSketch[T]) Add(item T) {
+	if err := s.TryAdd(item); err != nil {
+		panic(err)
 	}
 }
 
-func (s *REQSketch) Add(item float64) {
-	if math.IsNaN(item) {
-		panic("cannot add NaN")
+// TryAdd adds item. If item is NaN, it skips item with NaNPolicySkip, or
+// returns ErrNaNItem otherwise.
+func (s *REQSketch[T]) TryAdd(item T) error {
+	if isNaN(item) {
+		return s.handleNaN()
 	}
+	s.updateMinMax(item)
+	buf := s.compactors[0].buf
+	buf.Append(item)
+	s.retItems++
+	s.totalN++
+	if s.retItems >= s.maxNomSize {
+		buf.Sort()
+		s.compress()
+	}
+	s.reqSV = nil
+	return nil
+}
+
+func (s *REQSketch[T]) handleNaN() error {
+	if s.nanPolicy == NaNPolicySkip {
+		s.numNaNSkipped++
+		return nil
+	}
+	return ErrNaNItem
+}
+
+// AddAll adds items in bulk. If items contain NaN, it returns ErrNaNItem
+// without adding any item unless the NaN policy is NaNPolicySkip, in which
+// case NaN items are skipped. The result is the same as calling Add for
+// each item, but the level 0 buffer is filled up to the next compression
+// at once and sorted once per chunk.
+func (s *REQSketch[T]) AddAll(items []T) error {
+	for i, item := range items {
+		if !isNaN(item) {
+			continue
+		}
+		if s.nanPolicy != NaNPolicySkip {
+			return ErrNaNItem
+		}
+		// copy items so that the caller's slice is not modified.
+		valid := append([]T(nil), items[:i]...)
+		for _, item := range items[i:] {
+			if isNaN(item) {
+				s.numNaNSkipped++
+			} else {
+				valid = append(valid, item)
+			}
+		}
+		items = valid
+		break
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	minItem, maxItem := items[0], items[0]
+	for _, item := range items[1:] {
+		if s.lt(item, minItem) {
+			minItem = item
+		}
+		if s.lt(maxItem, item) {
+			maxItem = item
+		}
+	}
+	if s.empty() || s.lt(minItem, s.minItem) {
+		s.minItem = minItem
+	}
+	if s.empty() || s.lt(s.maxItem, maxItem) {
+		s.maxItem = maxItem
+	}
+	for len(items) > 0 {
+		n := s.maxNomSize - s.retItems
+		if n < 1 {
+			n = 1
+		} else if n > len(items) {
+			n = len(items)
+		}
+		buf := s.compactors[0].buf
+		buf.AppendAll(items[:n])
+		s.retItems += n
+		s.totalN += n
+		items = items[n:]
+		if s.retItems >= s.maxNomSize {
+			buf.Sort()
+			s.compress()
+		}
+	}
+	s.reqSV = nil
+	return nil
+}
+
+// AddWeighted adds item with weight, which is the same as adding item
+// weight times. The weight is decomposed into powers of two and item is
+// inserted into the compactor of the level for each bit set in weight,
+// since an item at level h has weight 1<<h. Levels created for weighted
+// items do not make the sketch in estimation mode until items are
+// compacted. NaN is handled in the same way as Add. It panics with
+// ErrInvalidWeight if weight is not positive; use TryAddWeighted to get an
+// error instead.
+func (s *REQSketch[T]) AddWeighted(item T, weight int) {
+	if err := s.TryAddWeighted(item, weight); err != nil {
+		panic(err)
+	}
+}
+
+// TryAddWeighted is the same as AddWeighted except that it returns
+// ErrInvalidWeight if weight is not positive, and handles NaN in the same
+// way as TryAdd. Nothing is added when it returns an error.
+func (s *REQSketch[T]) TryAddWeighted(item T, weight int) error {
+	if isNaN(item) {
+		return s.handleNaN()
+	}
+	if weight <= 0 {
+		return ErrInvalidWeight
+	}
+	s.updateMinMax(item)
+	for h := 0; weight>>h != 0; h++ {
+		if weight&(1<<h) == 0 {
+			continue
+		}
+		for h >= s.numLevels() {
+			s.grow()
+		}
+		buf := s.compactors[h].buf
+		if h == 0 {
+			buf.Append(item)
+		} else {
+			// levels above 0 are kept sorted
+			buf.insertSorted(item)
+		}
+		s.retItems++
+	}
+	s.totalN += weight
+	if s.retItems >= s.maxNomSize {
+		s.compactors[0].buf.Sort()
+		s.compress()
+	}
+	s.reqSV = nil
+	return nil
+}
+
+func (s *REQSketch[T]) updateMinMax(item T) {
 	if s.empty() {
 		s.minItem = item
 		s.maxItem = item
 	} else {
-		if item < s.minItem {
+		if s.lt(item, s.minItem) {
 			s.minItem = item
 		}
-		if item > s.maxItem {
+		if s.lt(s.maxItem, item) {
 			s.maxItem = item
 		}
 	}
-	buf := s.compactors[0].buf
-	buf.Append(item)
-	s.retItems++
-	s.totalN++
+}
+
+// lt reports whether a is less than b in the order of the sketch.
+func (s *REQSketch[T]) lt(a, b T) bool {
+	if s.less == nil {
+		return a < b
+	}
+	return s.less(a, b)
+}
+
+// isNaN reports whether x is NaN. It is always false for types other
+// than floating point numbers.
+func isNaN[T constraints.Ordered](x T) bool {
+	return x != x
+}
+
+// Merge merges other into s. Both sketches must have the same
+// high rank accuracy setting and order.
+func (s *REQSketch[T]) Merge(other *REQSketch[T]) error {
+	if other == nil || other.empty() {
+		return nil
+	}
+	if other.hra != s.hra {
+		return errHRAMismatch
+	}
+
+	if s.empty() || s.lt(other.minItem, s.minItem) {
+		s.minItem = other.minItem
+	}
+	if s.empty() || s.lt(s.maxItem, other.maxItem) {
+		s.maxItem = other.maxItem
+	}
+	s.totalN += other.totalN
+
+	// copy the compactors in case other == s, since merging into a
+	// compactor modifies its buffer
+	otherCompactors := other.compactors
+	if other == s {
+		otherCompactors = make([]reqCompactor[T], len(s.compactors))
+		for i, c := range s.compactors {
+			c.buf = c.buf.clone()
+			otherCompactors[i] = c
+		}
+	}
+
+	// grow until s has at least as many compactors as other
+	for s.numLevels() < len(otherCompactors) {
+		s.grow()
+	}
+	// merge the items in all height compactors
+	for i := range otherCompactors {
+		s.compactors[i].merge(&otherCompactors[i])
+	}
+
+	s.maxNomSize = s.computeMaxNomSize()
+	s.retItems = s.computeTotalRetainedItems()
 	if s.retItems >= s.maxNomSize {
-		buf.Sort()
-		// log.Printf("REQSketch.Add before compress, retItems=%d, maxNomSize=%d", s.retItems, s.maxNomSize)
 		s.compress()
-		// log.Printf("REQSketch.Add after compress, retItems=%d, maxNomSize=%d", s.retItems, s.maxNomSize)
 	}
 	s.reqSV = nil
+	return nil
 }
 
-func (s *REQSketch) Quantile(normRank float64, searchCrit QuantileSearchCriteria) (float64, error) {
+func (s *REQSketch[T]) Quantile(normRank float64, searchCrit QuantileSearchCriteria) (T, error) {
+	var zero T
 	if s.empty() {
-		return 0, errEmptySketch
+		return zero, errEmptySketch
 	}
 	if err := checkNormalizedRankBounds(normRank); err != nil {
-		return 0, err
+		return zero, err
 	}
 	s.refreshSortView()
 	return s.reqSV.Quantile(normRank, searchCrit)
 }
 
-func (s *REQSketch) refreshSortView() {
+// Quantiles returns the approximate items at normRanks, which is the same
+// as calling Quantile for each rank but builds the sorted view only once
+// and finds all items in a single pass. normRanks need not be sorted.
+func (s *REQSketch[T]) Quantiles(normRanks []float64, searchCrit QuantileSearchCriteria) ([]T, error) {
+	if s.empty() {
+		return nil, errEmptySketch
+	}
+	if err := checkNormalizedRanks(normRanks); err != nil {
+		return nil, err
+	}
+	s.refreshSortView()
+	return s.reqSV.Quantiles(normRanks, searchCrit)
+}
+
+// QuantilesEvenlySpaced returns the approximate items at n evenly spaced
+// normalized ranks from 0 to 1, inclusive. n must be at least 2.
+func (s *REQSketch[T]) QuantilesEvenlySpaced(n int, searchCrit QuantileSearchCriteria) ([]T, error) {
+	normRanks, err := evenlySpacedRanks(n)
+	if err != nil {
+		return nil, err
+	}
+	return s.Quantiles(normRanks, searchCrit)
+}
+
+// Rank returns the normalized rank of item, i.e. the approximate fraction
+// of items which are less than (or equal to, for the inclusive criteria) item.
+// item must not be NaN.
+func (s *REQSketch[T]) Rank(item T, searchCrit QuantileSearchCriteria) (float64, error) {
+	if s.empty() {
+		return 0, errEmptySketch
+	}
+	s.refreshSortView()
+	return s.reqSV.Rank(item, searchCrit)
+}
+
+// CDF returns the approximation to the Cumulative Distribution Function
+// at splitPoints. splitPoints must be unique, monotonically increasing and
+// must not contain NaN. The returned slice has len(splitPoints)+1 elements
+// and the last element is always 1.
+func (s *REQSketch[T]) CDF(splitPoints []T, searchCrit QuantileSearchCriteria) ([]float64, error) {
+	if s.empty() {
+		return nil, errEmptySketch
+	}
+	s.refreshSortView()
+	return s.reqSV.CDF(splitPoints, searchCrit)
+}
+
+// PMF returns the approximation to the Probability Mass Function of the
+// intervals separated by splitPoints. splitPoints must satisfy the same
+// conditions as CDF. The returned slice has len(splitPoints)+1 elements
+// and sums to 1.
+func (s *REQSketch[T]) PMF(splitPoints []T, searchCrit QuantileSearchCriteria) ([]float64, error) {
+	if s.empty() {
+		return nil, errEmptySketch
+	}
+	s.refreshSortView()
+	return s.reqSV.PMF(splitPoints, searchCrit)
+}
+
+// RankLowerBound returns an approximate lower bound of the given normalized
+// rank with numStdDev standard deviations (1, 2 or 3 is typical).
+func (s *REQSketch[T]) RankLowerBound(rank float64, numStdDev int) float64 {
+	return reqRankLowerBound(s.k, s.IsEstimationMode(), rank, numStdDev, s.hra, s.totalN)
+}
+
+// RankUpperBound returns an approximate upper bound of the given normalized
+// rank with numStdDev standard deviations (1, 2 or 3 is typical).
+func (s *REQSketch[T]) RankUpperBound(rank float64, numStdDev int) float64 {
+	return reqRankUpperBound(s.k, s.IsEstimationMode(), rank, numStdDev, s.hra, s.totalN)
+}
+
+// RSE returns an a priori estimate of the relative standard error (RSE,
+// expressed as a number in [0,1]) of the normalized rank for a sketch with
+// parameter k, high rank accuracy setting hra and totalN items. Like getRSE
+// of datasketches-java, it assumes the sketch is in estimation mode and
+// returns the upper bound of rank with one standard deviation.
+func RSE(k int, rank float64, hra bool, totalN int) float64 {
+	return reqRankUpperBound(k, true, rank, 1, hra, totalN)
+}
+
+func reqRankLowerBound(k int, estimation bool, rank float64, numStdDev int, hra bool, totalN int) float64 {
+	if reqExactRank(k, estimation, rank, hra, totalN) {
+		return rank
+	}
+	relative := relRseFactor / float64(k) * reqRelativeRankFactor(rank, hra)
+	fixed := fixRseFactor / float64(k)
+	lbRel := rank - float64(numStdDev)*relative
+	lbFix := rank - float64(numStdDev)*fixed
+	return math.Max(lbRel, lbFix)
+}
+
+func reqRankUpperBound(k int, estimation bool, rank float64, numStdDev int, hra bool, totalN int) float64 {
+	if reqExactRank(k, estimation, rank, hra, totalN) {
+		return rank
+	}
+	relative := relRseFactor / float64(k) * reqRelativeRankFactor(rank, hra)
+	fixed := fixRseFactor / float64(k)
+	ubRel := rank + float64(numStdDev)*relative
+	ubFix := rank + float64(numStdDev)*fixed
+	return math.Min(ubRel, ubFix)
+}
+
+func reqRelativeRankFactor(rank float64, hra bool) float64 {
+	if hra {
+		return 1 - rank
+	}
+	return rank
+}
+
+// reqExactRank returns whether the rank is exact, that is, the sketch is
+// not in estimation mode or the rank lies in the region of the level 0
+// compactor which is never compacted.
+func reqExactRank(k int, estimation bool, rank float64, hra bool, totalN int) bool {
+	baseCap := k * initialNumSections
+	if !estimation || totalN <= baseCap {
+		return true
+	}
+	exactRankThresh := float64(baseCap) / float64(totalN)
+	return hra && rank >= 1-exactRankThresh || !hra && rank <= exactRankThresh
+}
+
+// N returns the number of items added to the sketch.
+func (s *REQSketch[T]) N() int { return s.totalN }
+
+// NumRetained returns the number of items retained in the sketch.
+func (s *REQSketch[T]) NumRetained() int { return s.retItems }
+
+// IsEmpty returns whether no item has been added to the sketch.
+func (s *REQSketch[T]) IsEmpty() bool { return s.empty() }
+
+// IsEstimationMode returns whether the sketch has compacted items, that
+// is, quantiles and ranks may be approximate. A sketch holding weighted
+// items at levels above 0 is not in estimation mode until compacted.
+func (s *REQSketch[T]) IsEstimationMode() bool {
+	// The state of a compactor counts its compactions, and is carried
+	// over by Merge and serialization.
+	for i := range s.compactors {
+		if s.compactors[i].state != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// NumLevels returns the number of compactors.
+func (s *REQSketch[T]) NumLevels() int { return s.numLevels() }
+
+// K returns the parameter k of the sketch.
+func (s *REQSketch[T]) K() int { return s.k }
+
+// HighRankAccuracy returns whether the high ranks are prioritized for
+// better accuracy.
+func (s *REQSketch[T]) HighRankAccuracy() bool { return s.hra }
+
+// Min returns the minimum item added to the sketch.
+func (s *REQSketch[T]) Min() (T, error) {
+	if s.empty() {
+		var zero T
+		return zero, errEmptySketch
+	}
+	return s.minItem, nil
+}
+
+// Max returns the maximum item added to the sketch.
+func (s *REQSketch[T]) Max() (T, error) {
+	if s.empty() {
+		var zero T
+		return zero, errEmptySketch
+	}
+	return s.maxItem, nil
+}
+
+// Reset removes all items while keeping k, the high rank accuracy setting,
+// the seed or the random source and the NaN policy.
+func (s *REQSketch[T]) Reset() {
+	*s = *newREQSketch(s.k, s.hra, s.config(), s.less)
+}
+
+func (s *REQSketch[T]) refreshSortView() {
 	if s.reqSV == nil {
 		s.reqSV = newREQSketchSortView(s)
 	}
 }
 
-func (s *REQSketch) empty() bool { return s.totalN == 0 }
+func (s *REQSketch[T]) empty() bool { return s.totalN == 0 }
 
-func (s *REQSketch) grow() {
+func (s *REQSketch[T]) grow() {
 	lgWeight := s.numLevels()
-	s.compactors = append(s.compactors, newREQCompactor(s.hra, lgWeight, s.k))
+	s.compactors = append(s.compactors, newREQCompactor(s.hra, lgWeight, s.k, s.newCompactorRandom(lgWeight), s.less))
 	s.maxNomSize = s.computeMaxNomSize()
+	if s.tracer != nil {
+		s.tracer.OnGrow(REQGrowEvent{
+			NumLevels:  s.numLevels(),
+			MaxNomSize: s.maxNomSize,
+		})
+	}
 }
 
-func (s *REQSketch) numLevels() int { return len(s.compactors) }
+func (s *REQSketch[T]) numLevels() int { return len(s.compactors) }
 
-func (s *REQSketch) computeMaxNomSize() int {
+func (s *REQSketch[T]) computeMaxNomSize() int {
 	sz := 0
 	for i := range s.compactors {
 		sz += s.compactors[i].nomCapacity()
@@ -167,7 +758,15 @@ func (s *REQSketch) computeMaxNomSize() int {
 	return sz
 }
 
-func (s *REQSketch) compress() {
+func (s *REQSketch[T]) computeTotalRetainedItems() int {
+	count := 0
+	for i := range s.compactors {
+		count += s.compactors[i].buf.count
+	}
+	return count
+}
+
+func (s *REQSketch[T]) compress() {
 	for h := 0; h < len(s.compactors); h++ {
 		c := &s.compactors[h]
 		compRetItems := c.buf.count
@@ -175,54 +774,66 @@ func (s *REQSketch) compress() {
 		if compRetItems >= compNomCap {
 			if h+1 >= s.numLevels() { // at the top?
 				s.grow() // add a level, increases maxNomSize
+				// grow may reallocate s.compactors
+				c = &s.compactors[h]
 			}
 
 			promoted, deltaRetItems, deltaNomSize := c.compact()
-			// log.Printf("REQSketch.compress after compact, deltaRetItems=%d, deltaNomSize=%d", deltaRetItems, deltaNomSize)
 			s.compactors[h+1].buf.mergeSortIn(promoted)
 			s.retItems += deltaRetItems
 			s.maxNomSize += deltaNomSize
+			if s.tracer != nil {
+				s.tracer.OnCompact(REQCompactEvent{
+					LgWeight:    c.lgWeight,
+					State:       c.state,
+					SectionSize: c.sectionSize,
+					NumSections: c.numSections,
+					Coin:        c.coin,
+					NumPromoted: promoted.count,
+					RetItems:    s.retItems,
+					MaxNomSize:  s.maxNomSize,
+				})
+			}
 			// we specifically decided not to do lazy compression.
 		}
 	}
 	s.reqSV = nil
 }
 
-func newREQCompactor(hra bool, lgWeight int, sectionSize int) reqCompactor {
-	// log.Printf("newREQCompactor hra=%v, lgWeight=%d, sectionSize=%d", hra, lgWeight, sectionSize)
-	c := reqCompactor{
+func newREQCompactor[T constraints.Ordered](hra bool, lgWeight int, sectionSize int, random *rand.Rand, less func(a, b T) bool) reqCompactor[T] {
+	c := reqCompactor[T]{
 		lgWeight:       lgWeight,
 		hra:            hra,
 		sectionSize:    sectionSize,
 		sectionSizeFlt: float64(sectionSize),
 		numSections:    initialNumSections,
+		random:         random,
 	}
 
 	nomCap := c.nomCapacity()
-	c.buf = newFloatBuffer(2*nomCap, nomCap, hra)
-
-	// seed := time.Now().UnixNano()
-	seed := int64(1)
-	c.random = rand.New(rand.NewSource(seed))
+	capacity := 2 * nomCap
+	if lgWeight > 0 {
+		// allocated when items are promoted or added with weights, since
+		// levels created by AddWeighted may stay empty.
+		capacity = 0
+	}
+	c.buf = newItemBuffer(capacity, nomCap, hra, less)
 	return c
 }
 
-func (c *reqCompactor) nomCapacity() int {
+func (c *reqCompactor[T]) nomCapacity() int {
 	return capacityMultiplier * c.numSections * c.sectionSize
 }
 
-func (c *reqCompactor) compact() (buf *floatBuffer, deltaRetItems, deltaNomSize int) {
+func (c *reqCompactor[T]) compact() (buf *itemBuffer[T], deltaRetItems, deltaNomSize int) {
 	startRetItems := c.buf.count
 	startNomCap := c.nomCapacity()
 	// choose a part of the buffer to compact
 	secsToCompact := trailingOnes(c.state) + 1
-	// log.Printf("compact state=0x%x, numSections=%d", c.state, c.numSections)
 	if c.numSections < secsToCompact {
 		secsToCompact = c.numSections
 	}
-	// log.Printf("compact startRetItems=%d, startNomCap=%d, secsToCompact=%d", startRetItems, startNomCap, secsToCompact)
 	compactionStart, compactionEnd := c.computeCompactionRange(secsToCompact)
-	// log.Printf("compact compactionStart=%d, compactionEnd=%d", compactionStart, compactionEnd)
 	if compactionEnd-compactionStart < 2 {
 		panic("assertion failed: compactionEnd - compactionStart >= 2")
 	}
@@ -239,21 +850,37 @@ func (c *reqCompactor) compact() (buf *floatBuffer, deltaRetItems, deltaNomSize
 	c.ensureEnoughSections()
 	deltaRetItems = c.buf.count - startRetItems + promote.count
 	deltaNomSize = c.nomCapacity() - startNomCap
-	// log.Printf("compact, c.state=%d, deltaRetItems=%d, deltaNomSize=%d, len(promote.arr)=%d",
-	// c.state, deltaRetItems, deltaNomSize, len(promote.arr))
 	return promote, deltaRetItems, deltaNomSize
 }
 
+func (c *reqCompactor[T]) merge(other *reqCompactor[T]) {
+	if c.lgWeight != other.lgWeight {
+		panic("assertion failed: c.lgWeight == other.lgWeight")
+	}
+	c.state |= other.state
+	for c.ensureEnoughSections() {
+	}
+	c.buf.Sort()
+	otherBuf := other.buf
+	if !otherBuf.sorted {
+		otherBuf = otherBuf.clone()
+		otherBuf.Sort()
+	}
+	c.buf.mergeSortIn(otherBuf)
+}
+
 func trailingOnes(v uint) int {
 	return bits.TrailingZeros(^v)
 }
 
-func (c *reqCompactor) ensureEnoughSections() bool {
+func (c *reqCompactor[T]) ensureEnoughSections() bool {
 	if c.state < 1<<c.numSections-1 || c.sectionSize <= minK {
 		return false
 	}
 
-	szf := c.sectionSizeFlt / math.Sqrt2
+	// sectionSizeFlt is a float32 in datasketches-java, and so is it in the
+	// serialized form, so that the section sizes are the same.
+	szf := float64(float32(c.sectionSizeFlt / math.Sqrt2))
 	ne := nearestEven(szf)
 	if ne < minK {
 		return false
@@ -266,13 +893,14 @@ func (c *reqCompactor) ensureEnoughSections() bool {
 	return true
 }
 
+// nearestEven returns the even number nearest to v, rounding halves of v
+// up in the same way as datasketches-java.
 func nearestEven(v float64) int {
-	return int(math.RoundToEven(v))
+	return int(math.Round(v/2)) * 2
 }
 
-func (c *reqCompactor) computeCompactionRange(secsToCompact int) (start, end int) {
+func (c *reqCompactor[T]) computeCompactionRange(secsToCompact int) (start, end int) {
 	bufLen := c.buf.count
-	// log.Printf("computeCompactionRange start, bufLen=%d, nomCapacity=%d", bufLen, c.nomCapacity())
 	nonCompact := c.nomCapacity()/2 + (c.numSections-secsToCompact)*c.sectionSize
 	// make compacted region even
 	if (bufLen-nonCompact)&1 == 1 {
@@ -285,20 +913,26 @@ func (c *reqCompactor) computeCompactionRange(secsToCompact int) (start, end int
 	return nonCompact, bufLen
 }
 
-func newREQSketchSortView(s *REQSketch) *reqSketchSortedView {
-	v := &reqSketchSortedView{
+func newREQSketchSortView[T constraints.Ordered](s *REQSketch[T]) *sortedView[T] {
+	v := &sortedView[T]{
 		totalN: s.totalN,
+		less:   s.less,
 	}
 	v.buildSortedViewArrays(s)
 	return v
 }
 
-func (v *reqSketchSortedView) Quantile(normRank float64, searchCrit QuantileSearchCriteria) (float64, error) {
+func (v *sortedView[T]) Quantile(normRank float64, searchCrit QuantileSearchCriteria) (T, error) {
+	var zero T
 	if v.empty() {
-		return 0, errEmptySketch
+		return zero, errEmptySketch
 	}
 	if err := checkNormalizedRankBounds(normRank); err != nil {
-		return 0, err
+		return zero, err
+	}
+
+	if err := checkSearchCriteria(searchCrit); err != nil {
+		return zero, err
 	}
 
 	var f func(i int) bool
@@ -312,18 +946,120 @@ func (v *reqSketchSortedView) Quantile(normRank float64, searchCrit QuantileSear
 	}
 
 	i := sort.Search(len(v.cumWeights), f)
-	if i == -1 {
+	if i == len(v.cumWeights) {
 		return v.quantiles[len(v.quantiles)-1], nil // EXCLUSIVE (GT) case: normRank == 1.0
 	}
 	return v.quantiles[i], nil
 }
 
-func (v *reqSketchSortedView) empty() bool { return v.totalN == 0 }
+func (v *sortedView[T]) Quantiles(normRanks []float64, searchCrit QuantileSearchCriteria) ([]T, error) {
+	if v.empty() {
+		return nil, errEmptySketch
+	}
+	if err := checkNormalizedRanks(normRanks); err != nil {
+		return nil, err
+	}
+	if err := checkSearchCriteria(searchCrit); err != nil {
+		return nil, err
+	}
+
+	// The index found by Quantile is non-decreasing in the rank, so the
+	// search resumes from the previous index in ascending rank order.
+	quantiles := make([]T, len(normRanks))
+	i := 0
+	for _, j := range ascendingRankOrder(normRanks) {
+		if searchCrit == QuantileSearchCriteriaInclusive {
+			naturalRank := int(math.Ceil(normRanks[j] * float64(v.totalN)))
+			for i < len(v.cumWeights) && v.cumWeights[i] < naturalRank {
+				i++
+			}
+		} else {
+			naturalRank := int(math.Floor(normRanks[j] * float64(v.totalN)))
+			for i < len(v.cumWeights) && v.cumWeights[i] <= naturalRank {
+				i++
+			}
+		}
+		if i == len(v.cumWeights) {
+			quantiles[j] = v.quantiles[len(v.quantiles)-1] // EXCLUSIVE (GT) case: normRank == 1.0
+		} else {
+			quantiles[j] = v.quantiles[i]
+		}
+	}
+	return quantiles, nil
+}
+
+func (v *sortedView[T]) Rank(item T, searchCrit QuantileSearchCriteria) (float64, error) {
+	if v.empty() {
+		return 0, errEmptySketch
+	}
+	if err := checkSearchCriteria(searchCrit); err != nil {
+		return 0, err
+	}
+	if isNaN(item) {
+		return 0, errNaNRankItem
+	}
+
+	// find the last index i where quantiles[i] <= item (inclusive)
+	// or quantiles[i] < item (exclusive).
+	var f func(i int) bool
+	if searchCrit == QuantileSearchCriteriaInclusive {
+		f = func(i int) bool { return v.lt(item, v.quantiles[i]) }
+	} else {
+		f = func(i int) bool { return !v.lt(v.quantiles[i], item) }
+	}
+	i := sort.Search(len(v.quantiles), f) - 1
+	if i == -1 {
+		return 0, nil // item is less than (or equal to, for exclusive) the min quantile
+	}
+	return float64(v.cumWeights[i]) / float64(v.totalN), nil
+}
+
+func (v *sortedView[T]) CDF(splitPoints []T, searchCrit QuantileSearchCriteria) ([]float64, error) {
+	if v.empty() {
+		return nil, errEmptySketch
+	}
+	if err := checkSearchCriteria(searchCrit); err != nil {
+		return nil, err
+	}
+	if err := checkSplitPoints(splitPoints, v.lt); err != nil {
+		return nil, err
+	}
+
+	buckets := make([]float64, len(splitPoints)+1)
+	for i, p := range splitPoints {
+		r, err := v.Rank(p, searchCrit)
+		if err != nil {
+			return nil, err
+		}
+		buckets[i] = r
+	}
+	buckets[len(buckets)-1] = 1
+	return buckets, nil
+}
 
-func (v *reqSketchSortedView) buildSortedViewArrays(s *REQSketch) {
+func (v *sortedView[T]) PMF(splitPoints []T, searchCrit QuantileSearchCriteria) ([]float64, error) {
+	buckets, err := v.CDF(splitPoints, searchCrit)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(buckets) - 1; i > 0; i-- {
+		buckets[i] -= buckets[i-1]
+	}
+	return buckets, nil
+}
+
+func (v *sortedView[T]) empty() bool { return v.totalN == 0 }
+
+func (v *sortedView[T]) lt(a, b T) bool {
+	if v.less == nil {
+		return a < b
+	}
+	return v.less(a, b)
+}
+
+func (v *sortedView[T]) buildSortedViewArrays(s *REQSketch[T]) {
 	totalQuantiles := s.retItems
-	// log.Printf("buildSortedViewArrays totalQuantiles=%d", totalQuantiles)
-	v.quantiles = make([]float64, totalQuantiles)
+	v.quantiles = make([]T, totalQuantiles)
 	v.cumWeights = make([]int, totalQuantiles)
 	count := 0
 	for i := range s.compactors {
@@ -331,15 +1067,13 @@ func (v *reqSketchSortedView) buildSortedViewArrays(s *REQSketch) {
 		bufIn := c.buf
 		bufWeight := 1 << c.lgWeight
 		bufInLen := bufIn.count
-		// log.Printf("buildSortedViewArrays i=%d, bufWeight=%d", i, bufWeight)
 		v.mergeSortIn(bufIn, bufWeight, count, s.hra)
 		count += bufInLen
 	}
 	v.createCumulativeNativeRanks()
 }
 
-func (v *reqSketchSortedView) mergeSortIn(bufIn *floatBuffer, bufWeight, count int, hra bool) {
-	// log.Printf("reqSketchSortedView.mergeSortIn count=%d, bufIn.count=%d, bufIn.sorted=%v", count, bufIn.count, bufIn.sorted)
+func (v *sortedView[T]) mergeSortIn(bufIn *itemBuffer[T], bufWeight, count int, hra bool) {
 	if !bufIn.sorted {
 		bufIn.Sort()
 	}
@@ -347,7 +1081,6 @@ func (v *reqSketchSortedView) mergeSortIn(bufIn *floatBuffer, bufWeight, count i
 	arrIn := bufIn.arr
 	bufInLen := bufIn.count
 	totLen := count + bufInLen
-	// log.Printf("reqSketchSortedView.mergeSortIn totLen=%d", totLen)
 	i := count - 1
 	j := bufInLen - 1
 	var h int
@@ -359,7 +1092,7 @@ func (v *reqSketchSortedView) mergeSortIn(bufIn *floatBuffer, bufWeight, count i
 	for k := totLen; k > 0; {
 		k--
 		if i >= 0 && j >= 0 { // both valid
-			if v.quantiles[i] >= arrIn[h] {
+			if !v.lt(v.quantiles[i], arrIn[h]) {
 				v.quantiles[k] = v.quantiles[i]
 				v.cumWeights[k] = v.cumWeights[i] // not yet natRanks, just individual wts
 				i--
@@ -374,12 +1107,6 @@ func (v *reqSketchSortedView) mergeSortIn(bufIn *floatBuffer, bufWeight, count i
 			v.cumWeights[k] = v.cumWeights[i]
 			i--
 		} else if j >= 0 { // j is valid
-			if k >= len(v.quantiles) {
-				// log.Printf("reqSketchSortedView.mergeSortIn k=%d, len(v.quantiles)=%d", k, len(v.quantiles))
-			}
-			if h >= len(arrIn) {
-				// log.Printf("reqSketchSortedView.mergeSortIn h=%d, len(arrIn) =%d", h, len(arrIn))
-			}
 			v.quantiles[k] = arrIn[h]
 			v.cumWeights[k] = bufWeight
 			h--
@@ -390,7 +1117,7 @@ func (v *reqSketchSortedView) mergeSortIn(bufIn *floatBuffer, bufWeight, count i
 	}
 }
 
-func (v *reqSketchSortedView) createCumulativeNativeRanks() {
+func (v *sortedView[T]) createCumulativeNativeRanks() {
 	length := len(v.quantiles)
 	for i := 1; i < length; i++ {
 		v.cumWeights[i] += v.cumWeights[i-1]
@@ -402,31 +1129,48 @@ func (v *reqSketchSortedView) createCumulativeNativeRanks() {
 	}
 }
 
-func newFloatBuffer(capacity, delta int, spaceAtBottom bool) *floatBuffer {
-	return &floatBuffer{
-		arr:           make([]float64, capacity),
+func newItemBuffer[T constraints.Ordered](capacity, delta int, spaceAtBottom bool, less func(a, b T) bool) *itemBuffer[T] {
+	return &itemBuffer[T]{
+		arr:           make([]T, capacity),
 		count:         0,
 		capacity:      capacity,
 		delta:         delta,
 		sorted:        true,
 		spaceAtBottom: spaceAtBottom,
+		less:          less,
 	}
 }
 
-func wrapFloatBuffer(arr []float64, isSorted, spaceAtBottom bool) *floatBuffer {
-	b := &floatBuffer{
+func wrapItemBuffer[T constraints.Ordered](arr []T, isSorted, spaceAtBottom bool, less func(a, b T) bool) *itemBuffer[T] {
+	b := &itemBuffer[T]{
 		arr:           arr,
 		count:         len(arr),
 		capacity:      len(arr),
 		delta:         0,
 		sorted:        isSorted,
 		spaceAtBottom: spaceAtBottom,
+		less:          less,
 	}
 	b.Sort()
 	return b
 }
 
-func (b *floatBuffer) Append(item float64) {
+func (b *itemBuffer[T]) clone() *itemBuffer[T] {
+	b2 := *b
+	b2.arr = make([]T, len(b.arr))
+	copy(b2.arr, b.arr)
+	return &b2
+}
+
+// items returns the active region of the buffer, which is not copied.
+func (b *itemBuffer[T]) items() []T {
+	if b.spaceAtBottom {
+		return b.arr[b.capacity-b.count : b.capacity]
+	}
+	return b.arr[:b.count]
+}
+
+func (b *itemBuffer[T]) Append(item T) {
 	b.ensureSpace(1)
 
 	i := b.count
@@ -438,8 +1182,46 @@ func (b *floatBuffer) Append(item float64) {
 	b.sorted = false
 }
 
+// insertSorted inserts item into the sorted active region so that it stays
+// sorted.
+func (b *itemBuffer[T]) insertSorted(item T) {
+	if !b.sorted {
+		panic("buffer must be sorted")
+	}
+	b.ensureSpace(1)
+	if b.spaceAtBottom {
+		start := b.capacity - b.count
+		i := sort.Search(b.count, func(i int) bool { return b.lt(item, b.arr[start+i]) })
+		copy(b.arr[start-1:], b.arr[start:start+i])
+		b.arr[start-1+i] = item
+	} else {
+		i := sort.Search(b.count, func(i int) bool { return b.lt(item, b.arr[i]) })
+		copy(b.arr[i+1:b.count+1], b.arr[i:b.count])
+		b.arr[i] = item
+	}
+	b.count++
+}
+
+// AppendAll appends items in the same layout as calling Append for each
+// item.
+func (b *itemBuffer[T]) AppendAll(items []T) {
+	b.ensureSpace(len(items))
+
+	if b.spaceAtBottom {
+		i := b.capacity - b.count - 1
+		for _, item := range items {
+			b.arr[i] = item
+			i--
+		}
+	} else {
+		copy(b.arr[b.count:], items)
+	}
+	b.count += len(items)
+	b.sorted = false
+}
+
 // Sort sorts the active region
-func (b *floatBuffer) Sort() {
+func (b *itemBuffer[T]) Sort() {
 	if b.sorted {
 		return
 	}
@@ -448,17 +1230,21 @@ func (b *floatBuffer) Sort() {
 	if b.spaceAtBottom {
 		start, end = b.capacity-b.count, b.capacity
 	}
-	sort.Float64s(b.arr[start:end])
+	if b.less == nil {
+		slices.Sort(b.arr[start:end])
+	} else {
+		slices.SortFunc(b.arr[start:end], b.less)
+	}
 
 	b.sorted = true
 }
 
-func (b *floatBuffer) ensureCapacity(newCapacity int) {
+func (b *itemBuffer[T]) ensureCapacity(newCapacity int) {
 	if newCapacity <= b.capacity {
 		return
 	}
 
-	out := make([]float64, newCapacity)
+	out := make([]T, newCapacity)
 	if b.spaceAtBottom {
 		copy(out[newCapacity-b.count:], b.arr[b.capacity-b.count:b.capacity])
 	} else {
@@ -468,7 +1254,7 @@ func (b *floatBuffer) ensureCapacity(newCapacity int) {
 	b.capacity = newCapacity
 }
 
-func (b *floatBuffer) ensureSpace(space int) {
+func (b *itemBuffer[T]) ensureSpace(space int) {
 	if b.count+space <= b.capacity {
 		return
 	}
@@ -476,7 +1262,7 @@ func (b *floatBuffer) ensureSpace(space int) {
 	b.ensureCapacity(newCap)
 }
 
-func (b *floatBuffer) getEvensOrOdds(startOffset, endOffset int, odds bool) *floatBuffer {
+func (b *itemBuffer[T]) getEvensOrOdds(startOffset, endOffset int, odds bool) *itemBuffer[T] {
 	start, end := startOffset, endOffset
 	if b.spaceAtBottom {
 		off := b.capacity - b.count
@@ -486,7 +1272,6 @@ func (b *floatBuffer) getEvensOrOdds(startOffset, endOffset int, odds bool) *flo
 	b.Sort()
 	offsetRange := endOffset - startOffset
 	if offsetRange&1 == 1 {
-		// log.Printf("getEvensOrOdds startOffset=%d, endOffset=%d", startOffset, endOffset)
 		panic("input range size must be even")
 	}
 
@@ -494,17 +1279,16 @@ func (b *floatBuffer) getEvensOrOdds(startOffset, endOffset int, odds bool) *flo
 	if odds {
 		odd = 1
 	}
-	out := make([]float64, offsetRange/2)
+	out := make([]T, offsetRange/2)
 	for i, j := start+odd, 0; i < end; {
 		out[j] = b.arr[i]
 		i += 2
 		j++
 	}
-	return wrapFloatBuffer(out, true, b.spaceAtBottom)
+	return wrapItemBuffer(out, true, b.spaceAtBottom, b.less)
 }
 
-func (b *floatBuffer) mergeSortIn(bufIn *floatBuffer) {
-	// log.Printf("floatBuffer.mergeSortIn start, b.count=%d, b.capacity=%d, bufIn.count=%d", b.count, b.capacity, bufIn.count)
+func (b *itemBuffer[T]) mergeSortIn(bufIn *itemBuffer[T]) {
 	if !b.sorted || !bufIn.sorted {
 		panic("both buffers must be sorted")
 	}
@@ -512,7 +1296,6 @@ func (b *floatBuffer) mergeSortIn(bufIn *floatBuffer) {
 	arrIn := bufIn.arr
 	bufInLen := bufIn.count
 	b.ensureSpace(bufInLen)
-	// log.Printf("floatBuffer.mergeSortIn after ensureSpace, b.count=%d, b.capacity=%d", b.count, b.capacity)
 	totLen := b.count + bufInLen
 	if b.spaceAtBottom { // scan up, insert at bottom
 		tgtStart := b.capacity - totLen
@@ -520,7 +1303,7 @@ func (b *floatBuffer) mergeSortIn(bufIn *floatBuffer) {
 		j := bufIn.capacity - bufIn.count
 		for k := tgtStart; k < b.capacity; k++ {
 			if i < b.capacity && j < bufIn.capacity { // both valid
-				if b.arr[i] <= arrIn[j] {
+				if !b.lt(arrIn[j], b.arr[i]) {
 					b.arr[k] = b.arr[i]
 					i++
 				} else {
@@ -543,7 +1326,7 @@ func (b *floatBuffer) mergeSortIn(bufIn *floatBuffer) {
 		for k := totLen; k > 0; {
 			k--
 			if i >= 0 && j >= 0 { // both valid
-				if b.arr[i] >= arrIn[j] {
+				if !b.lt(b.arr[i], arrIn[j]) {
 					b.arr[k] = b.arr[i]
 					i--
 				} else {
@@ -563,18 +1346,80 @@ func (b *floatBuffer) mergeSortIn(bufIn *floatBuffer) {
 	}
 	b.count += bufInLen
 	b.sorted = true
-	// log.Printf("floatBuffer.mergeSortIn exit, b.count=%d", b.count)
 }
 
-func (b *floatBuffer) trimCount(newCount int) {
+func (b *itemBuffer[T]) lt(x, y T) bool {
+	if b.less == nil {
+		return x < y
+	}
+	return b.less(x, y)
+}
+
+func (b *itemBuffer[T]) trimCount(newCount int) {
 	if newCount < b.count {
 		b.count = newCount
 	}
 }
 
+func checkSearchCriteria(searchCrit QuantileSearchCriteria) error {
+	if searchCrit != QuantileSearchCriteriaInclusive && searchCrit != QuantileSearchCriteriaExclusive {
+		return errInvalidSearchCriteria
+	}
+	return nil
+}
+
+func checkSplitPoints[T constraints.Ordered](splitPoints []T, lt func(a, b T) bool) error {
+	for i, p := range splitPoints {
+		if isNaN(p) {
+			return errNaNSplitPoint
+		}
+		if i > 0 && !lt(splitPoints[i-1], p) {
+			return errSplitPointsNotIncreasing
+		}
+	}
+	return nil
+}
+
+// checkNormalizedRankBounds returns errNormalizedRankOutOfBounds if rank is
+// NaN or not in the range [0, 1].
 func checkNormalizedRankBounds(rank float64) error {
-	if rank < 0 || rank > 1 {
+	if !(rank >= 0 && rank <= 1) {
 		return errNormalizedRankOutOfBounds
 	}
 	return nil
 }
+
+func checkNormalizedRanks(ranks []float64) error {
+	for _, rank := range ranks {
+		if err := checkNormalizedRankBounds(rank); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ascendingRankOrder returns the indexes of ranks in the ascending order
+// of ranks. ranks must not contain NaN.
+func ascendingRankOrder(ranks []float64) []int {
+	order := make([]int, len(ranks))
+	for i := range order {
+		order[i] = i
+	}
+	if !sort.Float64sAreSorted(ranks) {
+		sort.SliceStable(order, func(i, j int) bool { return ranks[order[i]] < ranks[order[j]] })
+	}
+	return order
+}
+
+// evenlySpacedRanks returns n evenly spaced normalized ranks from 0 to 1,
+// inclusive.
+func evenlySpacedRanks(n int) ([]float64, error) {
+	if n < 2 {
+		return nil, errTooFewEvenlySpaced
+	}
+	ranks := make([]float64, n)
+	for i := range ranks {
+		ranks[i] = float64(i) / float64(n-1)
+	}
+	return ranks, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// REQTracer receives events of the internal state changes of a REQSketch.
+// It is intended for debugging. Methods are called synchronously from the
+// method of the sketch which caused the event.
+type REQTracer interface {
+	// OnGrow is called after a compactor is added on top of the sketch.
+	OnGrow(ev REQGrowEvent)
+	// OnCompact is called after a compactor is compacted and the
+	// promoted items are merged into the next level.
+	OnCompact(ev REQCompactEvent)
+}
+
+// REQGrowEvent describes the sketch after a compactor is added.
+type REQGrowEvent struct {
+	NumLevels  int // number of compactors including the new one
+	MaxNomSize int // sum of nominal capacities of all compactors
+}
+
+// REQCompactEvent describes a compactor and the sketch after a compaction.
+type REQCompactEvent struct {
+	LgWeight    int  // level of the compacted compactor
+	State       uint // state of the compaction schedule
+	SectionSize int
+	NumSections int
+	Coin        bool // whether odd items were promoted
+	NumPromoted int  // number of items promoted to the next level
+	RetItems    int  // number of retained items in the sketch
+	MaxNomSize  int  // sum of nominal capacities of all compactors
+}
+
+// WithTracer makes the sketch call tracer on grow and compact events.
+func WithTracer(tracer REQTracer) REQSketchOption {
+	return func(c *reqSketchConfig) {
+		c.tracer = tracer
+	}
+}
+
+// String returns a summary of the sketch and its compactors without items.
+func (s *REQSketch[T]) String() string {
+	return s.DebugString(false)
+}
+
+// DebugString returns a summary of the sketch and its compactors, one
+// compactor per line. If withItems is true, the retained items of each
+// compactor are also printed in the order they are stored.
+func (s *REQSketch[T]) DebugString(withItems bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "REQSketch k=%d, hra=%v, n=%d, retItems=%d, maxNomSize=%d, numLevels=%d",
+		s.k, s.hra, s.totalN, s.retItems, s.maxNomSize, s.numLevels())
+	if !s.empty() {
+		fmt.Fprintf(&b, ", min=%v, max=%v", s.minItem, s.maxItem)
+	}
+	b.WriteByte('\n')
+	for i := range s.compactors {
+		c := &s.compactors[i]
+		fmt.Fprintf(&b, "  compactor lgWeight=%d, state=0x%x, sectionSize=%d, numSections=%d, coin=%v, nomCapacity=%d, count=%d, capacity=%d, sorted=%v\n",
+			c.lgWeight, c.state, c.sectionSize, c.numSections, c.coin, c.nomCapacity(), c.buf.count, c.buf.capacity, c.buf.sorted)
+		if withItems {
+			fmt.Fprintf(&b, "    items=%v\n", c.buf.items())
+		}
+	}
+	return b.String()
+}
+
+// Validate checks the internal invariants of the sketch and returns an
+// error describing the first violation found. It is intended for tests
+// and debugging.
+func (s *REQSketch[T]) Validate() error {
+	retItems := 0
+	weightedCount := 0
+	for h := range s.compactors {
+		c := &s.compactors[h]
+		if c.lgWeight != h {
+			return fmt.Errorf("compactor lgWeight mismatch, h=%d, lgWeight=%d", h, c.lgWeight)
+		}
+		if c.buf.count > c.buf.capacity {
+			return fmt.Errorf("buffer count exceeds capacity, h=%d, count=%d, capacity=%d", h, c.buf.count, c.buf.capacity)
+		}
+		items := c.buf.items()
+		if c.buf.sorted {
+			for i := 1; i < len(items); i++ {
+				if s.lt(items[i], items[i-1]) {
+					return fmt.Errorf("buffer flagged sorted is not sorted, h=%d, i=%d", h, i)
+				}
+			}
+		}
+		for i, item := range items {
+			if s.lt(item, s.minItem) || s.lt(s.maxItem, item) {
+				return fmt.Errorf("item out of min/max, h=%d, i=%d, item=%v, min=%v, max=%v", h, i, item, s.minItem, s.maxItem)
+			}
+		}
+		retItems += c.buf.count
+		weightedCount += c.buf.count << c.lgWeight
+	}
+	if retItems != s.retItems {
+		return fmt.Errorf("retItems mismatch, got=%d, want=%d", s.retItems, retItems)
+	}
+	if maxNomSize := s.computeMaxNomSize(); maxNomSize != s.maxNomSize {
+		return fmt.Errorf("maxNomSize mismatch, got=%d, want=%d", s.maxNomSize, maxNomSize)
+	}
+	if weightedCount != s.totalN {
+		return fmt.Errorf("sum of weighted counts mismatch, got=%d, want=%d", weightedCount, s.totalN)
+	}
+	if !s.empty() && s.lt(s.maxItem, s.minItem) {
+		return fmt.Errorf("min is greater than max, min=%v, max=%v", s.minItem, s.maxItem)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+type recordingREQTracer struct {
+	grows    []REQGrowEvent
+	compacts []REQCompactEvent
+}
+
+func (r *recordingREQTracer) OnGrow(ev REQGrowEvent)       { r.grows = append(r.grows, ev) }
+func (r *recordingREQTracer) OnCompact(ev REQCompactEvent) { r.compacts = append(r.compacts, ev) }
+
+func TestREQSketch_DebugString(t *testing.T) {
+	s := NewREQSketch[float64](12, true, WithDeterministic())
+	if got, want := s.String(), "REQSketch k=12, hra=true, n=0, retItems=0, maxNomSize=72, numLevels=1\n"+
+		"  compactor lgWeight=0, state=0x0, sectionSize=12, numSections=3, coin=false, nomCapacity=72, count=0, capacity=144, sorted=true\n"; got != want {
+		t.Errorf("string mismatch,\ngot=%s\nwant=%s", got, want)
+	}
+
+	for _, v := range []float64{3, 1, 2} {
+		s.Add(v)
+	}
+	got := s.DebugString(true)
+	if want := "n=3, retItems=3"; !strings.Contains(got, want) {
+		t.Errorf("debug string must contain %q, got=%s", want, got)
+	}
+	if want := ", min=1, max=3\n"; !strings.Contains(got, want) {
+		t.Errorf("debug string must contain %q, got=%s", want, got)
+	}
+	// items are stored from the end of the buffer in reverse order for hra
+	if want := "    items=[2 1 3]\n"; !strings.Contains(got, want) {
+		t.Errorf("debug string must contain %q, got=%s", want, got)
+	}
+	if strings.Contains(s.String(), "items=") {
+		t.Errorf("string must not contain items, got=%s", s.String())
+	}
+
+	for i := 0; i < 1000; i++ {
+		s.Add(float64(i))
+	}
+	got = s.DebugString(false)
+	if got, want := strings.Count(got, "  compactor "), s.NumLevels(); got != want {
+		t.Errorf("compactor line count mismatch, got=%d, want=%d", got, want)
+	}
+}
+
+func TestREQSketch_Tracer(t *testing.T) {
+	tracer := &recordingREQTracer{}
+	s := NewREQSketch[float64](12, false, WithDeterministic(), WithTracer(tracer))
+	for i := 0; i < 10000; i++ {
+		s.Add(float64(i))
+	}
+
+	if got, want := len(tracer.grows), s.NumLevels(); got != want {
+		t.Errorf("grow event count mismatch, got=%d, want=%d", got, want)
+	}
+	for i, ev := range tracer.grows {
+		if got, want := ev.NumLevels, i+1; got != want {
+			t.Errorf("numLevels mismatch, i=%d, got=%d, want=%d", i, got, want)
+		}
+	}
+	if len(tracer.compacts) == 0 {
+		t.Fatal("compact events must be recorded")
+	}
+	for i, ev := range tracer.compacts {
+		if ev.LgWeight < 0 || ev.LgWeight >= s.NumLevels()-1 {
+			t.Errorf("lgWeight out of range, i=%d, lgWeight=%d", i, ev.LgWeight)
+		}
+		if ev.NumPromoted <= 0 {
+			t.Errorf("numPromoted must be positive, i=%d, numPromoted=%d", i, ev.NumPromoted)
+		}
+		if ev.RetItems > ev.MaxNomSize {
+			t.Errorf("retItems must not exceed maxNomSize, i=%d, retItems=%d, maxNomSize=%d",
+				i, ev.RetItems, ev.MaxNomSize)
+		}
+	}
+
+	// the tracer is kept after Reset.
+	numGrows := len(tracer.grows)
+	s.Reset()
+	if got, want := len(tracer.grows), numGrows+1; got != want {
+		t.Errorf("grow event count mismatch after reset, got=%d, want=%d", got, want)
+	}
+}
+
+func TestREQSketch_Validate(t *testing.T) {
+	newSketch := func() *REQSketch[float64] {
+		s := NewREQSketch[float64](12, true, WithDeterministic())
+		for i := 0; i < 1000; i++ {
+			s.Add(float64(i))
+		}
+		if err := s.Validate(); err != nil {
+			t.Fatalf("valid sketch must pass, err=%s", err)
+		}
+		return s
+	}
+
+	testCases := []struct {
+		name    string
+		corrupt func(s *REQSketch[float64])
+	}{
+		{name: "retItems", corrupt: func(s *REQSketch[float64]) { s.retItems++ }},
+		{name: "maxNomSize", corrupt: func(s *REQSketch[float64]) { s.maxNomSize++ }},
+		{name: "totalN", corrupt: func(s *REQSketch[float64]) { s.totalN++ }},
+		{name: "min", corrupt: func(s *REQSketch[float64]) { s.minItem = 500 }},
+		{name: "max", corrupt: func(s *REQSketch[float64]) { s.maxItem = 500 }},
+		{name: "sorted", corrupt: func(s *REQSketch[float64]) {
+			items := s.compactors[1].buf.items()
+			items[0], items[1] = items[1], items[0]
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newSketch()
+			tc.corrupt(s)
+			if err := s.Validate(); err == nil {
+				t.Errorf("corrupted sketch must fail")
+			}
+		})
+	}
+}
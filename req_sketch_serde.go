@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// The binary format is the one used by the REQ sketch of Apache DataSketches
+// (ReqSerDe.java). All multi-byte values are little endian.
+//
+// Preamble (8 bytes):
+//
+//	byte 0:    preamble ints (2, or 4 for the estimation format)
+//	byte 1:    serialization version (1)
+//	byte 2:    family ID (17)
+//	byte 3:    flags
+//	bytes 4-5: k
+//	byte 6:    number of compactors
+//	byte 7:    number of raw items
+//
+// The estimation format is followed by totalN (int64), minItem (float32)
+// and maxItem (float32), and then by each compactor.
+//
+// Compactor:
+//
+//	bytes 0-7:   state
+//	bytes 8-11:  sectionSizeFlt (float32)
+//	byte 12:     lgWeight
+//	byte 13:     numSections
+//	bytes 14-15: padding
+//	bytes 16-19: count
+//	bytes 20-:   count items (float32)
+//
+// The format does not carry the coin of compactors, so it restarts from
+// false after unmarshaling.
+
+const (
+	reqSerVer   = 1
+	reqFamilyID = 17
+
+	reqFlagEmpty        = 4
+	reqFlagHRA          = 8
+	reqFlagRawItems     = 16
+	reqFlagLevel0Sorted = 32
+
+	reqPreIntsExact      = 2
+	reqPreIntsEstimation = 4
+
+	reqPreambleSize         = 8
+	reqEstimationHeaderSize = 24
+	reqCompactorHeaderSize  = 20
+	reqItemSize             = 4
+
+	reqMaxRawItems = minK
+)
+
+type reqSerDeFormat int
+
+const (
+	reqSerDeFormatEmpty reqSerDeFormat = iota
+	reqSerDeFormatRawItems
+	reqSerDeFormatExact
+	reqSerDeFormatEstimation
+)
+
+var (
+	errREQSerDeTooShort     = errors.New("REQ sketch data is too short")
+	errREQSerDeVersion      = errors.New("unsupported REQ sketch serialization version")
+	errREQSerDeFamily       = errors.New("not a REQ sketch family ID")
+	errREQSerDePreInts      = errors.New("invalid REQ sketch preamble ints")
+	errREQSerDeInvalidK     = errors.New("invalid k in REQ sketch data")
+	errREQSerDeInvalidCount = errors.New("invalid item count in REQ sketch data")
+	errREQSerDeInvalidN     = errors.New("totalN mismatch with compactors in REQ sketch data")
+	errREQSerDeCompactor    = errors.New("invalid compactor in REQ sketch data")
+	errREQSerDeInconsistent = errors.New("inconsistent REQ sketch data")
+	errREQSerDeNaNItem      = errors.New("NaN item in REQ sketch data")
+	errREQSerDeItemType     = errors.New("only REQSketch[float64] in the natural order can be serialized")
+)
+
+// MarshalBinary encodes the sketch in the Apache DataSketches REQ sketch
+// format. Since that format stores items as float32, items are rounded to
+// the nearest float32 value. Only REQSketch[float64] without WithLess is
+// supported.
+func (s *REQSketch[T]) MarshalBinary() ([]byte, error) {
+	fs, ok := any(s).(*REQSketch[float64])
+	if !ok || s.less != nil {
+		return nil, errREQSerDeItemType
+	}
+	return marshalREQSketch(fs), nil
+}
+
+func marshalREQSketch(s *REQSketch[float64]) []byte {
+	format := s.serFormat()
+	preInts := byte(reqPreIntsExact)
+	if format == reqSerDeFormatEstimation {
+		preInts = reqPreIntsEstimation
+	}
+	numCompactors := byte(0)
+	if !s.empty() {
+		numCompactors = byte(s.numLevels())
+	}
+	numRawItems := byte(0)
+	if s.serRawItems() {
+		numRawItems = byte(s.totalN)
+	}
+
+	data := make([]byte, reqPreambleSize, s.serBytes(format))
+	data[0] = preInts
+	data[1] = reqSerVer
+	data[2] = reqFamilyID
+	data[3] = s.serFlags()
+	binary.LittleEndian.PutUint16(data[4:], uint16(s.k))
+	data[6] = numCompactors
+	data[7] = numRawItems
+
+	switch format {
+	case reqSerDeFormatEmpty:
+	case reqSerDeFormatRawItems:
+		buf := s.compactors[0].buf
+		for i := 0; i < buf.count; i++ {
+			data = appendFloat32(data, buf.item(i))
+		}
+	case reqSerDeFormatExact:
+		data = appendREQCompactorBinary(data, &s.compactors[0])
+	default:
+		data = binary.LittleEndian.AppendUint64(data, uint64(s.totalN))
+		data = appendFloat32(data, s.minItem)
+		data = appendFloat32(data, s.maxItem)
+		for i := range s.compactors {
+			data = appendREQCompactorBinary(data, &s.compactors[i])
+		}
+	}
+	return data
+}
+
+// UnmarshalBinary decodes data in the Apache DataSketches REQ sketch format
+// and replaces the content of s with it. k, highRankAccuracy and the items
+// are taken from data. The seed, the random source, the NaN policy and the
+// tracer of s are kept, so that the compactors of a sketch seeded with
+// WithSeed or WithDeterministic restart the same coin flips. If s is the
+// zero value, the seed is taken from the current time and the NaN policy
+// is NaNPolicyPanic. The count returned by NumNaNSkipped is reset to zero.
+// Only REQSketch[float64] in the natural order is supported. Malformed data
+// is rejected with an error and s is left unchanged.
+func (s *REQSketch[T]) UnmarshalBinary(data []byte) error {
+	fs, ok := any(s).(*REQSketch[float64])
+	if !ok || s.less != nil {
+		return errREQSerDeItemType
+	}
+	return unmarshalREQSketch(fs, data)
+}
+
+func unmarshalREQSketch(s *REQSketch[float64], data []byte) error {
+	cfg := s.config()
+	if s.k == 0 {
+		// s was not created by a constructor.
+		cfg.seed = time.Now().UnixNano()
+	}
+
+	if len(data) < reqPreambleSize {
+		return errREQSerDeTooShort
+	}
+	preInts := data[0]
+	if data[1] != reqSerVer {
+		return errREQSerDeVersion
+	}
+	if data[2] != reqFamilyID {
+		return errREQSerDeFamily
+	}
+	flags := data[3]
+	empty := flags&reqFlagEmpty != 0
+	hra := flags&reqFlagHRA != 0
+	rawItems := flags&reqFlagRawItems != 0
+	level0Sorted := flags&reqFlagLevel0Sorted != 0
+	k := int(binary.LittleEndian.Uint16(data[4:]))
+	if k&1 != 0 || k < minK || k > 1024 {
+		return errREQSerDeInvalidK
+	}
+	numCompactors := int(data[6])
+	numRawItems := int(data[7])
+	data = data[reqPreambleSize:]
+
+	format := reqDeserFormat(empty, rawItems, numCompactors)
+	wantPreInts := byte(reqPreIntsExact)
+	if format == reqSerDeFormatEstimation {
+		wantPreInts = reqPreIntsEstimation
+	}
+	if preInts != wantPreInts {
+		return errREQSerDePreInts
+	}
+
+	switch format {
+	case reqSerDeFormatEmpty:
+		*s = *newREQSketch[float64](k, hra, cfg, nil)
+	case reqSerDeFormatRawItems:
+		if numRawItems == 0 || numRawItems > reqMaxRawItems {
+			return errREQSerDeInvalidCount
+		}
+		if len(data) < numRawItems*reqItemSize {
+			return errREQSerDeTooShort
+		}
+		s2 := newREQSketch[float64](k, hra, cfg, nil)
+		for i := 0; i < numRawItems; i++ {
+			item := readFloat32(data[i*reqItemSize:])
+			if math.IsNaN(item) {
+				return errREQSerDeNaNItem
+			}
+			s2.Add(item)
+		}
+		*s = *s2
+	case reqSerDeFormatExact:
+		c, _, err := unmarshalREQCompactor(data, k, 0, level0Sorted, hra)
+		if err != nil {
+			return err
+		}
+		if c.buf.count == 0 {
+			return errREQSerDeInvalidCount
+		}
+		s2 := &REQSketch[float64]{
+			k:          k,
+			hra:        hra,
+			seed:       cfg.seed,
+			randSource: cfg.randSource,
+			nanPolicy:  cfg.nanPolicy,
+			tracer:     cfg.tracer,
+			totalN:     c.buf.count,
+			compactors: []reqCompactor[float64]{c},
+		}
+		s2.minItem, s2.maxItem = c.buf.minMax()
+		s2.initCompactorRandoms()
+		s2.maxNomSize = s2.computeMaxNomSize()
+		s2.retItems = s2.computeTotalRetainedItems()
+		if err := s2.Validate(); err != nil {
+			return fmt.Errorf("%w: %s", errREQSerDeInconsistent, err)
+		}
+		*s = *s2
+	default:
+		if len(data) < reqEstimationHeaderSize-reqPreambleSize {
+			return errREQSerDeTooShort
+		}
+		s2 := &REQSketch[float64]{
+			k:          k,
+			hra:        hra,
+			seed:       cfg.seed,
+			randSource: cfg.randSource,
+			nanPolicy:  cfg.nanPolicy,
+			tracer:     cfg.tracer,
+			totalN:     int(binary.LittleEndian.Uint64(data)),
+			minItem:    readFloat32(data[8:]),
+			maxItem:    readFloat32(data[12:]),
+		}
+		if math.IsNaN(s2.minItem) || math.IsNaN(s2.maxItem) {
+			return errREQSerDeNaNItem
+		}
+		data = data[reqEstimationHeaderSize-reqPreambleSize:]
+		weightedCount := 0
+		for h := 0; h < numCompactors; h++ {
+			sorted := h != 0 || level0Sorted
+			c, n, err := unmarshalREQCompactor(data, k, h, sorted, hra)
+			if err != nil {
+				return err
+			}
+			s2.compactors = append(s2.compactors, c)
+			weightedCount += c.buf.count << h
+			data = data[n:]
+		}
+		if s2.totalN <= 0 || weightedCount != s2.totalN {
+			return errREQSerDeInvalidN
+		}
+		s2.initCompactorRandoms()
+		s2.maxNomSize = s2.computeMaxNomSize()
+		s2.retItems = s2.computeTotalRetainedItems()
+		if err := s2.Validate(); err != nil {
+			return fmt.Errorf("%w: %s", errREQSerDeInconsistent, err)
+		}
+		*s = *s2
+	}
+	return nil
+}
+
+func (s *REQSketch[T]) initCompactorRandoms() {
+	for i := range s.compactors {
+		c := &s.compactors[i]
+		c.random = s.newCompactorRandom(c.lgWeight)
+	}
+}
+
+func (s *REQSketch[T]) serFormat() reqSerDeFormat {
+	switch {
+	case s.empty():
+		return reqSerDeFormatEmpty
+	case s.serRawItems():
+		return reqSerDeFormatRawItems
+	case s.numLevels() == 1:
+		return reqSerDeFormatExact
+	default:
+		return reqSerDeFormatEstimation
+	}
+}
+
+// serRawItems returns whether the sketch is small enough for the raw items
+// format, which holds only the items at level 0. Items added by AddWeighted
+// may be at upper levels even if totalN is small.
+func (s *REQSketch[T]) serRawItems() bool {
+	return s.totalN <= reqMaxRawItems && s.numLevels() == 1 && s.compactors[0].buf.count == s.totalN
+}
+
+func reqDeserFormat(empty, rawItems bool, numCompactors int) reqSerDeFormat {
+	if numCompactors <= 1 {
+		if empty {
+			return reqSerDeFormatEmpty
+		}
+		if rawItems {
+			return reqSerDeFormatRawItems
+		}
+		return reqSerDeFormatExact
+	}
+	return reqSerDeFormatEstimation
+}
+
+func (s *REQSketch[T]) serBytes(format reqSerDeFormat) int {
+	switch format {
+	case reqSerDeFormatEmpty:
+		return reqPreambleSize
+	case reqSerDeFormatRawItems:
+		return reqPreambleSize + s.compactors[0].buf.count*reqItemSize
+	case reqSerDeFormatExact:
+		return reqPreambleSize + s.compactors[0].serBytes()
+	default:
+		n := reqEstimationHeaderSize
+		for i := range s.compactors {
+			n += s.compactors[i].serBytes()
+		}
+		return n
+	}
+}
+
+func (s *REQSketch[T]) serFlags() byte {
+	var flags byte
+	if s.empty() {
+		flags |= reqFlagEmpty
+	}
+	if s.hra {
+		flags |= reqFlagHRA
+	}
+	if s.serRawItems() {
+		flags |= reqFlagRawItems
+	}
+	if s.compactors[0].buf.sorted {
+		flags |= reqFlagLevel0Sorted
+	}
+	return flags
+}
+
+func (c *reqCompactor[T]) serBytes() int {
+	return reqCompactorHeaderSize + c.buf.count*reqItemSize
+}
+
+func appendREQCompactorBinary(data []byte, c *reqCompactor[float64]) []byte {
+	data = binary.LittleEndian.AppendUint64(data, uint64(c.state))
+	data = binary.LittleEndian.AppendUint32(data, math.Float32bits(float32(c.sectionSizeFlt)))
+	data = append(data, byte(c.lgWeight), byte(c.numSections), 0, 0)
+	data = binary.LittleEndian.AppendUint32(data, uint32(c.buf.count))
+	for i := 0; i < c.buf.count; i++ {
+		data = appendFloat32(data, c.buf.item(i))
+	}
+	return data
+}
+
+// unmarshalREQCompactor decodes the compactor at level h of a sketch with
+// parameter k at the start of data and returns it with the number of bytes
+// consumed. The section size starts at k and only shrinks.
+func unmarshalREQCompactor(data []byte, k, h int, sorted, hra bool) (c reqCompactor[float64], n int, err error) {
+	if len(data) < reqCompactorHeaderSize {
+		return reqCompactor[float64]{}, 0, errREQSerDeTooShort
+	}
+	state := binary.LittleEndian.Uint64(data)
+	sectionSizeFlt := float64(readFloat32(data[8:]))
+	sectionSize := nearestEven(sectionSizeFlt)
+	lgWeight := int(data[12])
+	numSections := int(data[13])
+	count := int(binary.LittleEndian.Uint32(data[16:]))
+	if lgWeight != h || numSections < initialNumSections || sectionSize < minK || sectionSize > k {
+		return reqCompactor[float64]{}, 0, errREQSerDeCompactor
+	}
+	if count > (len(data)-reqCompactorHeaderSize)/reqItemSize {
+		return reqCompactor[float64]{}, 0, errREQSerDeInvalidCount
+	}
+
+	c = newREQCompactor[float64](hra, lgWeight, sectionSize, nil, nil)
+	c.state = uint(state)
+	c.sectionSizeFlt = sectionSizeFlt
+	c.numSections = numSections
+	nomCap := c.nomCapacity()
+	capacity := 2 * nomCap
+	if count > capacity {
+		capacity = count
+	}
+	c.buf = newItemBuffer[float64](capacity, nomCap, hra, nil)
+	c.buf.count = count
+	for i := 0; i < count; i++ {
+		item := readFloat32(data[reqCompactorHeaderSize+i*reqItemSize:])
+		if math.IsNaN(item) {
+			return reqCompactor[float64]{}, 0, errREQSerDeNaNItem
+		}
+		c.buf.setItem(i, item)
+	}
+	c.buf.sorted = sorted
+	return c, reqCompactorHeaderSize + count*reqItemSize, nil
+}
+
+// item returns the i-th item in the active region.
+func (b *itemBuffer[T]) item(i int) T {
+	return b.arr[b.index(i)]
+}
+
+func (b *itemBuffer[T]) setItem(i int, item T) {
+	b.arr[b.index(i)] = item
+}
+
+func (b *itemBuffer[T]) index(i int) int {
+	if b.spaceAtBottom {
+		return b.capacity - b.count + i
+	}
+	return i
+}
+
+// minMax returns the minimum and maximum items in the active region,
+// which must not be empty.
+func (b *itemBuffer[T]) minMax() (min, max T) {
+	min, max = b.item(0), b.item(0)
+	for i := 1; i < b.count; i++ {
+		v := b.item(i)
+		if b.lt(v, min) {
+			min = v
+		}
+		if b.lt(max, v) {
+			max = v
+		}
+	}
+	return min, max
+}
+
+func appendFloat32(data []byte, v float64) []byte {
+	return binary.LittleEndian.AppendUint32(data, math.Float32bits(float32(v)))
+}
+
+func readFloat32(data []byte) float64 {
+	return float64(math.Float32frombits(binary.LittleEndian.Uint32(data)))
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+// Golden files are never overwritten, so that a change of the encoding
+// is noticed. To change them intentionally, delete them and run the tests
+// with -create-golden.
+var createGolden = flag.Bool("create-golden", false, "create missing golden files in testdata")
+
+func TestREQSketch_MarshalBinaryEmpty(t *testing.T) {
+	s := NewREQSketch[float64](12, false)
+	got, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x02, 0x01, 0x11, 0x34, 0x0c, 0x00, 0x00, 0x00}
+	if !bytes.Equal(got, want) {
+		t.Errorf("bytes mismatch, got=% x, want=% x", got, want)
+	}
+}
+
+func TestREQSketch_MarshalBinaryRawItems(t *testing.T) {
+	testCases := []struct {
+		hra  bool
+		want []byte
+	}{
+		{
+			hra: false,
+			want: []byte{
+				0x02, 0x01, 0x11, 0x10, 0x0c, 0x00, 0x01, 0x04,
+				0x00, 0x00, 0x40, 0x41, // 12
+				0x00, 0x00, 0xc0, 0x40, // 6
+				0x00, 0x00, 0x20, 0x41, // 10
+				0x00, 0x00, 0x80, 0x3f, // 1
+			},
+		},
+		{
+			hra: true,
+			want: []byte{
+				0x02, 0x01, 0x11, 0x18, 0x0c, 0x00, 0x01, 0x04,
+				0x00, 0x00, 0x80, 0x3f, // 1
+				0x00, 0x00, 0x20, 0x41, // 10
+				0x00, 0x00, 0xc0, 0x40, // 6
+				0x00, 0x00, 0x40, 0x41, // 12
+			},
+		},
+	}
+	for _, tc := range testCases {
+		s := NewREQSketch[float64](12, tc.hra)
+		for _, v := range []float64{12, 6, 10, 1} {
+			s.Add(v)
+		}
+		got, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("bytes mismatch, hra=%v, got=% x, want=% x", tc.hra, got, tc.want)
+		}
+	}
+}
+
+func TestREQSketch_BinaryGolden(t *testing.T) {
+	testCases := []struct {
+		name string
+		k    int
+		hra  bool
+		n    int
+	}{
+		{name: "req_k12_lra_empty.bin", k: 12, hra: false, n: 0},
+		{name: "req_k12_hra_raw.bin", k: 12, hra: true, n: 3},
+		{name: "req_k12_lra_exact.bin", k: 12, hra: false, n: 50},
+		{name: "req_k12_hra_exact.bin", k: 12, hra: true, n: 50},
+		{name: "req_k12_lra_estimation.bin", k: 12, hra: false, n: 1000},
+		{name: "req_k12_hra_estimation.bin", k: 12, hra: true, n: 1000},
+		// the section size of the lower levels is shrunk to 7 before
+		// rounding to an even number.
+		{name: "req_k14_hra_estimation.bin", k: 14, hra: true, n: 10000},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewREQSketch[float64](tc.k, tc.hra, WithDeterministic())
+			rnd := rand.New(rand.NewSource(1))
+			for i := 0; i < tc.n; i++ {
+				// use float32 values so that the round trip is lossless
+				s.Add(float64(rnd.Float32()))
+			}
+			got, err := s.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join("testdata", tc.name)
+			if *createGolden {
+				if err := createFile(path, got); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("bytes mismatch with golden file %s", path)
+			}
+
+			var s2 REQSketch[float64]
+			if err := s2.UnmarshalBinary(want); err != nil {
+				t.Fatalf("unmarshal: err=%s", err)
+			}
+			if got, want := s2.N(), s.N(); got != want {
+				t.Errorf("totalN mismatch, got=%d, want=%d", got, want)
+			}
+			if got, want := s2.NumLevels(), s.NumLevels(); got != want {
+				t.Errorf("numLevels mismatch, got=%d, want=%d", got, want)
+			}
+			for h := 0; h < s.NumLevels() && h < s2.NumLevels(); h++ {
+				if got, want := s2.compactors[h].sectionSize, s.compactors[h].sectionSize; got != want {
+					t.Errorf("sectionSize mismatch, h=%d, got=%d, want=%d", h, got, want)
+				}
+			}
+			if tc.n == 0 {
+				return
+			}
+			gotMin, _ := s2.Min()
+			wantMin, _ := s.Min()
+			if gotMin != wantMin {
+				t.Errorf("min mismatch, got=%g, want=%g", gotMin, wantMin)
+			}
+			gotMax, _ := s2.Max()
+			wantMax, _ := s.Max()
+			if gotMax != wantMax {
+				t.Errorf("max mismatch, got=%g, want=%g", gotMax, wantMax)
+			}
+			pValues := []float64{0, 0.25, 0.5, 0.75, 0.99, 1}
+			for _, searchCrit := range []QuantileSearchCriteria{QuantileSearchCriteriaInclusive, QuantileSearchCriteriaExclusive} {
+				got := make([]float64, len(pValues))
+				want := make([]float64, len(pValues))
+				for i, p := range pValues {
+					if got[i], err = s2.Quantile(p, searchCrit); err != nil {
+						t.Fatalf("quantile: p=%g, err=%s", p, err)
+					}
+					if want[i], err = s.Quantile(p, searchCrit); err != nil {
+						t.Fatalf("quantile: p=%g, err=%s", p, err)
+					}
+				}
+				if !slices.Equal(got, want) {
+					t.Errorf("quantiles mismatch, searchCrit=%d, got=%v, want=%v", searchCrit, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestREQSketch_UnmarshalBinaryInvalid(t *testing.T) {
+	testCases := []struct {
+		data []byte
+		want error
+	}{
+		{data: []byte{0x02, 0x01, 0x11}, want: errREQSerDeTooShort},
+		{data: []byte{0x02, 0x02, 0x11, 0x34, 0x0c, 0x00, 0x00, 0x00}, want: errREQSerDeVersion},
+		{data: []byte{0x02, 0x01, 0x0f, 0x34, 0x0c, 0x00, 0x00, 0x00}, want: errREQSerDeFamily},
+		{data: []byte{0x04, 0x01, 0x11, 0x34, 0x0c, 0x00, 0x00, 0x00}, want: errREQSerDePreInts},
+		{data: []byte{0x02, 0x01, 0x11, 0x34, 0x0b, 0x00, 0x00, 0x00}, want: errREQSerDeInvalidK},
+		{data: []byte{0x02, 0x01, 0x11, 0x10, 0x0c, 0x00, 0x01, 0x02, 0x00, 0x00, 0x40, 0x41}, want: errREQSerDeTooShort},
+		{data: []byte{0x02, 0x01, 0x11, 0x10, 0x0c, 0x00, 0x01, 0x01, 0x00, 0x00, 0xc0, 0x7f}, want: errREQSerDeNaNItem},
+		// raw items format with no items
+		{data: []byte{0x02, 0x01, 0x11, 0x10, 0x0c, 0x00, 0x01, 0x00}, want: errREQSerDeInvalidCount},
+		// raw items format with more items than reqMaxRawItems
+		{data: []byte{
+			0x02, 0x01, 0x11, 0x10, 0x0c, 0x00, 0x01, 0x05,
+			0x00, 0x00, 0x80, 0x3f,
+			0x00, 0x00, 0x00, 0x40,
+			0x00, 0x00, 0x40, 0x40,
+			0x00, 0x00, 0x80, 0x40,
+			0x00, 0x00, 0xa0, 0x40,
+		}, want: errREQSerDeInvalidCount},
+		// exact format with no items
+		{data: []byte{
+			0x02, 0x01, 0x11, 0x08, 0x0c, 0x00, 0x01, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // state
+			0x00, 0x00, 0x40, 0x41, // sectionSizeFlt
+			0x00, 0x03, 0x00, 0x00, // lgWeight, numSections
+			0x00, 0x00, 0x00, 0x00, // count
+		}, want: errREQSerDeInvalidCount},
+		{data: []byte{
+			0x02, 0x01, 0x11, 0x00, 0x0c, 0x00, 0x01, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x40, 0x41,
+			0x00, 0x03, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00,
+		}, want: errREQSerDeInvalidCount},
+		// exact format with lgWeight of 1
+		{data: []byte{
+			0x02, 0x01, 0x11, 0x08, 0x0c, 0x00, 0x01, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x40, 0x41,
+			0x01, 0x03, 0x00, 0x00,
+			0x01, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x80, 0x3f,
+		}, want: errREQSerDeCompactor},
+		// exact format with unsorted items flagged sorted
+		{data: []byte{
+			0x02, 0x01, 0x11, 0x28, 0x0c, 0x00, 0x01, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x40, 0x41,
+			0x00, 0x03, 0x00, 0x00,
+			0x02, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x40, // 2
+			0x00, 0x00, 0x80, 0x3f, // 1
+		}, want: errREQSerDeInconsistent},
+	}
+	for i, tc := range testCases {
+		var s REQSketch[float64]
+		if err := s.UnmarshalBinary(tc.data); !errors.Is(err, tc.want) {
+			t.Errorf("error mismatch, case=%d, got=%v, want=%v", i, err, tc.want)
+		}
+	}
+}
+
+func TestREQSketch_UnmarshalBinarySectionSize(t *testing.T) {
+	// datasketches-java rounds sectionSizeFlt to the nearest even number
+	// with round(v/2)*2, which gives 8 for 7 instead of 7.
+	data := []byte{
+		0x02, 0x01, 0x11, 0x08, 0x0e, 0x00, 0x01, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // state
+		0x00, 0x00, 0xe0, 0x40, // sectionSizeFlt = 7
+		0x00, 0x0c, 0x00, 0x00, // lgWeight, numSections
+		0x01, 0x00, 0x00, 0x00, // count
+		0x00, 0x00, 0x80, 0x3f, // 1
+	}
+	var s REQSketch[float64]
+	if err := s.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.compactors[0].sectionSize, 8; got != want {
+		t.Errorf("sectionSize mismatch, got=%d, want=%d", got, want)
+	}
+}
+
+func TestNearestEven(t *testing.T) {
+	testCases := []struct {
+		input float64
+		want  int
+	}{
+		{input: 4.242641, want: 4},
+		{input: 5, want: 6},
+		{input: 6, want: 6},
+		{input: 7, want: 8},
+		{input: 8.485281, want: 8},
+		{input: 9, want: 10},
+		{input: 9.899495, want: 10},
+	}
+	for _, tc := range testCases {
+		if got := nearestEven(tc.input); got != tc.want {
+			t.Errorf("result mismatch, input=%g, got=%d, want=%d", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestREQSketch_UnmarshalBinaryInvalidEstimation(t *testing.T) {
+	const (
+		totalNOffset    = reqPreambleSize
+		minOffset       = reqPreambleSize + 8
+		compactorOffset = reqEstimationHeaderSize
+	)
+	testCases := []struct {
+		name   string
+		mutate func(data []byte)
+		want   error
+	}{
+		{
+			name:   "numSections",
+			mutate: func(data []byte) { data[compactorOffset+13] = 0 },
+			want:   errREQSerDeCompactor,
+		},
+		{
+			name: "sectionSize",
+			mutate: func(data []byte) {
+				binary.LittleEndian.PutUint32(data[compactorOffset+8:], math.Float32bits(2))
+			},
+			want: errREQSerDeCompactor,
+		},
+		{
+			name: "largeSectionSize",
+			mutate: func(data []byte) {
+				binary.LittleEndian.PutUint32(data[compactorOffset+8:], math.Float32bits(1e30))
+			},
+			want: errREQSerDeCompactor,
+		},
+		{
+			name:   "lgWeight",
+			mutate: func(data []byte) { data[compactorOffset+12] = 1 },
+			want:   errREQSerDeCompactor,
+		},
+		{
+			name: "totalN",
+			mutate: func(data []byte) {
+				n := binary.LittleEndian.Uint64(data[totalNOffset:])
+				binary.LittleEndian.PutUint64(data[totalNOffset:], n+1)
+			},
+			want: errREQSerDeInvalidN,
+		},
+		{
+			name: "zeroTotalN",
+			mutate: func(data []byte) {
+				binary.LittleEndian.PutUint64(data[totalNOffset:], 0)
+			},
+			want: errREQSerDeInvalidN,
+		},
+		{
+			name: "min",
+			mutate: func(data []byte) {
+				binary.LittleEndian.PutUint32(data[minOffset:], math.Float32bits(0.5))
+			},
+			want: errREQSerDeInconsistent,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "req_k12_hra_estimation.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.mutate(data)
+			var s REQSketch[float64]
+			if err := s.UnmarshalBinary(data); !errors.Is(err, tc.want) {
+				t.Errorf("error mismatch, got=%v, want=%v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestREQSketch_BinarySmallWeighted(t *testing.T) {
+	type weighted struct {
+		item   float64
+		weight int
+	}
+	testCases := [][]weighted{
+		{{item: 5, weight: 4}},
+		{{item: 5, weight: 2}, {item: 3, weight: 1}},
+		{{item: 1, weight: 3}, {item: 2, weight: 1}},
+		{{item: 7, weight: 5}, {item: 2, weight: 6}},
+	}
+	for i, tc := range testCases {
+		for _, hra := range []bool{false, true} {
+			s := NewREQSketch[float64](12, hra)
+			for _, w := range tc {
+				s.AddWeighted(w.item, w.weight)
+			}
+			data, err := s.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var s2 REQSketch[float64]
+			if err := s2.UnmarshalBinary(data); err != nil {
+				t.Fatalf("unmarshal: case=%d, hra=%v, data=% x, err=%s", i, hra, data, err)
+			}
+			checkValid(t, &s2)
+			if got, want := s2.N(), s.N(); got != want {
+				t.Errorf("totalN mismatch, case=%d, hra=%v, got=%d, want=%d", i, hra, got, want)
+			}
+			if got, want := s2.NumRetained(), s.NumRetained(); got != want {
+				t.Errorf("numRetained mismatch, case=%d, hra=%v, got=%d, want=%d", i, hra, got, want)
+			}
+			for _, p := range []float64{0, 0.25, 0.5, 0.75, 1} {
+				got, err := s2.Quantile(p, QuantileSearchCriteriaInclusive)
+				if err != nil {
+					t.Fatalf("quantile: p=%g, err=%s", p, err)
+				}
+				want, _ := s.Quantile(p, QuantileSearchCriteriaInclusive)
+				if got != want {
+					t.Errorf("quantile mismatch, case=%d, hra=%v, p=%g, got=%g, want=%g", i, hra, p, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestREQSketch_UnmarshalBinaryKeepsConfig(t *testing.T) {
+	for _, n := range []int{0, 3, 50, 1000} {
+		src := NewREQSketch[float64](12, true)
+		for i := 1; i <= n; i++ {
+			src.Add(float64(i))
+		}
+		data, err := src.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tracer := &recordingREQTracer{}
+		s := NewREQSketch[float64](8, false, WithSeed(7), WithNaNPolicy(NaNPolicySkip), WithTracer(tracer))
+		if err := s.UnmarshalBinary(data); err != nil {
+			t.Fatalf("unmarshal: n=%d, err=%s", n, err)
+		}
+		if got, want := s.Seed(), int64(7); got != want {
+			t.Errorf("seed mismatch, n=%d, got=%d, want=%d", n, got, want)
+		}
+		if err := s.TryAdd(math.NaN()); err != nil {
+			t.Errorf("NaN must be skipped, n=%d, err=%v", n, err)
+		}
+		if got, want := s.NumNaNSkipped(), 1; got != want {
+			t.Errorf("numNaNSkipped mismatch, n=%d, got=%d, want=%d", n, got, want)
+		}
+
+		// the same seed must make the same coin flips after decoding.
+		s2 := NewREQSketch[float64](8, false, WithSeed(7))
+		if err := s2.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			s.Add(float64(i))
+			s2.Add(float64(i))
+		}
+		if len(tracer.compacts) == 0 {
+			t.Errorf("tracer must be kept, n=%d", n)
+		}
+		for _, p := range []float64{0, 0.25, 0.5, 0.75, 1} {
+			got, err := s.Quantile(p, QuantileSearchCriteriaInclusive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := s2.Quantile(p, QuantileSearchCriteriaInclusive)
+			if got != want {
+				t.Errorf("quantile mismatch for the same seed, n=%d, p=%g, got=%g, want=%g", n, p, got, want)
+			}
+		}
+	}
+
+	s := NewREQSketch[float64](12, true, WithLess(func(a, b float64) bool { return a > b }))
+	if err := s.UnmarshalBinary([]byte{0x02, 0x01, 0x11, 0x34, 0x0c, 0x00, 0x00, 0x00}); err != errREQSerDeItemType {
+		t.Errorf("error mismatch for custom order, got=%v, want=%v", err, errREQSerDeItemType)
+	}
+}
+
+// createFile writes data to a new file at path. It does nothing if the
+// file exists.
+func createFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// TestREQSketch_UnmarshalDataSketchesJava decodes the sketches serialized
+// by ReqSketch.toByteArray of datasketches-java, which are generated by
+// testdata/datasketches/GenerateReqFixtures.java. The items added are a
+// permutation of 1..n. The decoded sketches must be encoded back in the
+// same bytes, and so must the sketches built in Go from the same items
+// before any compaction. The generator checks the other direction by
+// decoding the golden files of TestREQSketch_BinaryGolden in Java.
+func TestREQSketch_UnmarshalDataSketchesJava(t *testing.T) {
+	testCases := []struct {
+		format string
+		n      int
+		exact  bool
+	}{
+		{format: "empty", n: 0, exact: true},
+		{format: "raw", n: 3, exact: true},
+		{format: "exact", n: 50, exact: true},
+		{format: "estimation", n: 1000, exact: false},
+	}
+	for _, hra := range []bool{false, true} {
+		for _, tc := range testCases {
+			name := fmt.Sprintf("req_k12_%s_%s_java.sk", map[bool]string{false: "lra", true: "hra"}[hra], tc.format)
+			t.Run(name, func(t *testing.T) {
+				data, err := os.ReadFile(filepath.Join("testdata", "datasketches", name))
+				if errors.Is(err, fs.ErrNotExist) {
+					t.Fatalf("%s is missing, generate it with GenerateReqFixtures.java", name)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				var s REQSketch[float64]
+				if err := s.UnmarshalBinary(data); err != nil {
+					t.Fatalf("unmarshal: err=%s", err)
+				}
+				checkValid(t, &s)
+				// Raw items are decoded by adding them one by one, which
+				// reverses their order in a high rank accuracy buffer, so
+				// only the other formats are encoded in the same bytes.
+				if tc.format != "raw" {
+					if got, err := s.MarshalBinary(); err != nil {
+						t.Fatalf("marshal: err=%s", err)
+					} else if !bytes.Equal(got, data) {
+						t.Errorf("bytes mismatch after round trip of %s", name)
+					}
+				}
+				if tc.exact {
+					// No compaction has happened, so a sketch built in Go
+					// with the same items must be encoded in the same bytes.
+					s2 := NewREQSketch[float64](12, hra)
+					for j := 0; j < tc.n; j++ {
+						s2.Add(float64(j*7919%tc.n + 1))
+					}
+					if got, err := s2.MarshalBinary(); err != nil {
+						t.Fatalf("marshal: err=%s", err)
+					} else if !bytes.Equal(got, data) {
+						t.Errorf("bytes mismatch with %s for the same items", name)
+					}
+				}
+				if got, want := s.N(), tc.n; got != want {
+					t.Fatalf("totalN mismatch, got=%d, want=%d", got, want)
+				}
+				if got, want := s.HighRankAccuracy(), hra; got != want {
+					t.Errorf("highRankAccuracy mismatch, got=%v, want=%v", got, want)
+				}
+				if tc.n == 0 {
+					if !s.IsEmpty() {
+						t.Errorf("sketch must be empty")
+					}
+					return
+				}
+				if got, err := s.Min(); err != nil || got != 1 {
+					t.Errorf("min mismatch, got=%g, err=%v, want=1", got, err)
+				}
+				if got, err := s.Max(); err != nil || got != float64(tc.n) {
+					t.Errorf("max mismatch, got=%g, err=%v, want=%d", got, err, tc.n)
+				}
+				for _, p := range []float64{0, 0.25, 0.5, 0.75, 0.99, 1} {
+					got, err := s.Quantile(p, QuantileSearchCriteriaInclusive)
+					if err != nil {
+						t.Fatalf("quantile: p=%g, err=%s", p, err)
+					}
+					if tc.exact {
+						if want := math.Max(1, math.Ceil(p*float64(tc.n))); got != want {
+							t.Errorf("quantile mismatch, p=%g, got=%g, want=%g", p, got, want)
+						}
+						continue
+					}
+					// the normalized rank of item v is v/n.
+					margin := reqRelativeRankErrorBound(12, hra, p) + 1/float64(tc.n)
+					if rank := got / float64(tc.n); math.Abs(rank-p) > margin {
+						t.Errorf("quantile rank out of range, p=%g, got=%g, rank=%g, margin=%g", p, got, rank, margin)
+					}
+				}
+			})
+		}
+	}
+}
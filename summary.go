@@ -2,15 +2,34 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"math"
 	"sort"
 )
 
+var (
+	errNoValueAdded = errors.New("no value added")
+	errNilSummary   = errors.New("cannot combine with nil summary")
+	errNotFound     = errors.New("quantile not found")
+)
+
+// ErrInvalidEpsilon is returned when epsilon of Summary is not in the
+// range (0, 0.5].
+var ErrInvalidEpsilon = errors.New("epsilon must be in the range (0, 0.5]")
+
 type Summary struct {
 	tuples              []tuple
 	compressingInterval int
 	epsilon             float64
-	n                   int
+	n                   int // number of values in tuples
+
+	// values not merged into tuples yet, flushed when it has
+	// compressingInterval values or before queries
+	buffer []float64
+	// reused as the destination of merges to avoid allocations
+	spare []tuple
+
+	bandCompression bool
 }
 
 type tuple struct {
@@ -19,38 +38,111 @@ type tuple struct {
 	delta int
 }
 
-func NewSummary(epsilon float64) *Summary {
+// SummaryOption configures a Summary.
+type SummaryOption func(*summaryConfig)
+
+type summaryConfig struct {
+	bandCompression bool
+}
+
+// WithBandCompression makes the summary compress tuples with the band
+// based COMPRESS of the original paper by Greenwald and Khanna, which
+// guarantees the space bound of O((1/epsilon)*log(epsilon*n)) tuples.
+// A tuple is merged only into a neighbor of the same or a higher band,
+// together with its descendants in the tree of bands. Without this
+// option, neighboring tuples are merged greedily in a single linear pass,
+// which is faster but has no worst case space bound.
+func WithBandCompression() SummaryOption {
+	return func(c *summaryConfig) {
+		c.bandCompression = true
+	}
+}
+
+// NewSummary creates a Summary. It panics if epsilon is invalid.
+func NewSummary(epsilon float64, opts ...SummaryOption) *Summary {
+	s, err := NewSummaryE(epsilon, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// NewSummaryE creates a Summary. It returns ErrInvalidEpsilon if epsilon
+// is not in the range (0, 0.5].
+func NewSummaryE(epsilon float64, opts ...SummaryOption) (*Summary, error) {
+	if !(epsilon > 0 && epsilon <= 0.5) {
+		return nil, ErrInvalidEpsilon
+	}
+	var cfg summaryConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	return &Summary{
 		epsilon:             epsilon,
 		compressingInterval: int(math.Floor(1 / (2 * epsilon))),
-	}
+		bandCompression:     cfg.bandCompression,
+	}, nil
 }
 
+// Add adds v. Values are buffered and merged into the tuples in batches.
 func (s *Summary) Add(v float64) {
-	i := sort.Search(len(s.tuples), func(i int) bool { return s.tuples[i].value >= v })
-	delta := 0
-	if i > 0 && i < len(s.tuples) {
-		delta = int(math.Floor(2 * s.epsilon * float64(s.n)))
+	s.buffer = append(s.buffer, v)
+	if len(s.buffer) >= s.compressingInterval {
+		s.flush()
 	}
-	t := tuple{value: v, gap: 1, delta: delta}
+}
 
-	if i < len(s.tuples) {
-		s.tuples = append(s.tuples, tuple{})
-		copy(s.tuples[i+1:], s.tuples[i:])
-		s.tuples[i] = t
-	} else {
-		s.tuples = append(s.tuples, t)
+// flush merges the buffered values into the tuples in one linear pass with
+// compression fused into it, or followed by bandCompress with
+// WithBandCompression.
+//
+// A buffered value inserted between two tuples gets the delta of
+// floor(2*epsilon*n) where n is the number of values before the flush, so
+// that the invariant gap+delta <= floor(2*epsilon*n)+1 of the old tuples
+// bounds its rank in the same way as inserting values one by one. Values
+// inserted before the first or after the last tuple get the delta of 0.
+func (s *Summary) flush() {
+	if len(s.buffer) == 0 {
+		return
 	}
-	s.n++
+	sort.Float64s(s.buffer)
 
-	if s.n%s.compressingInterval == 0 {
-		s.compress()
+	delta := int(math.Floor(2 * s.epsilon * float64(s.n)))
+	s.n += len(s.buffer)
+	threshold := int(math.Floor(2 * s.epsilon * float64(s.n)))
+	out := s.spare[:0]
+	var i, j int
+	for i < len(s.tuples) || j < len(s.buffer) {
+		var t tuple
+		// a buffered value is inserted before the tuples of equal values
+		if j < len(s.buffer) && (i == len(s.tuples) || s.buffer[j] <= s.tuples[i].value) {
+			t = tuple{value: s.buffer[j], gap: 1}
+			if i > 0 && i < len(s.tuples) {
+				t.delta = delta
+			}
+			j++
+		} else {
+			t = s.tuples[i]
+			i++
+		}
+		if s.bandCompression {
+			out = append(out, t)
+		} else {
+			out = appendCompressed(out, t, threshold)
+		}
+	}
+	s.spare = s.tuples[:0]
+	s.tuples = out
+	s.buffer = s.buffer[:0]
+	if s.bandCompression {
+		s.bandCompress()
 	}
 }
 
 func (s *Summary) Quantile(p float64) (float64, error) {
+	s.flush()
 	if len(s.tuples) == 0 {
-		return 0, errors.New("no value added")
+		return 0, errNoValueAdded
 	}
 
 	rank := p*float64(s.n) + 1
@@ -73,26 +165,298 @@ func (s *Summary) Quantile(p float64) (float64, error) {
 		}
 	}
 	if bestIndex == -1 {
-		return 0, errors.New("quantile not found")
+		return 0, errNotFound
 	}
 	return s.tuples[bestIndex].value, nil
 }
 
+// Quantiles returns the values at ps, which is the same as calling
+// Quantile for each p but scans the tuples only once. ps must be in the
+// range [0, 1] and need not be sorted.
+func (s *Summary) Quantiles(ps []float64) ([]float64, error) {
+	s.flush()
+	if len(s.tuples) == 0 {
+		return nil, errNoValueAdded
+	}
+	if err := checkNormalizedRanks(ps); err != nil {
+		return nil, err
+	}
+
+	// rMin is non-decreasing and rMin <= rMax, so the candidates of
+	// Quantile for p are the tuples with rMin in
+	// [rankMinusMargin, rankPlusMargin]. Both ends of the range are
+	// non-decreasing in p, so the start of the scan only moves forward.
+	values := make([]float64, len(ps))
+	margin := int(math.Ceil(s.epsilon * float64(s.n)))
+	start := 0
+	rMinStart := s.tuples[0].gap
+	for _, j := range ascendingRankOrder(ps) {
+		rank := ps[j]*float64(s.n) + 1
+		rankMinusMargin := int(rank) - margin
+		rankPlusMargin := int(rank) + margin
+		for start < len(s.tuples)-1 && rMinStart < rankMinusMargin {
+			start++
+			rMinStart += s.tuples[start].gap
+		}
+
+		bestIndex := -1
+		bestDist := math.MaxFloat64
+		rMin := rMinStart
+		for i := start; i < len(s.tuples) && rMin <= rankPlusMargin; i++ {
+			if i > start {
+				rMin += s.tuples[i].gap
+			}
+			rMax := rMin + s.tuples[i].delta
+			if rankMinusMargin <= rMin && rMax <= rankPlusMargin {
+				currentDist := math.Abs(rank - float64(rMin+rMax)/2)
+				if currentDist < bestDist {
+					bestDist = currentDist
+					bestIndex = i
+				}
+			}
+		}
+		if bestIndex == -1 {
+			return nil, errNotFound
+		}
+		values[j] = s.tuples[bestIndex].value
+	}
+	return values, nil
+}
+
+// QuantilesEvenlySpaced returns the values at n evenly spaced ranks from
+// 0 to 1, inclusive. n must be at least 2.
+func (s *Summary) QuantilesEvenlySpaced(n int) ([]float64, error) {
+	ps, err := evenlySpacedRanks(n)
+	if err != nil {
+		return nil, err
+	}
+	return s.Quantiles(ps)
+}
+
+// Rank returns the guaranteed interval of the rank of v, that is, one plus
+// the number of values less than v. The rank is the same as the one
+// returned by SummaryNaiveImpl.Rank for the same values.
+func (s *Summary) Rank(v float64) (min, max int) {
+	s.flush()
+	rMin := 0
+	for i := range s.tuples {
+		t := &s.tuples[i]
+		if t.value >= v {
+			// t is the first tuple whose value is v or larger, so at most
+			// rMin+t.gap+t.delta-1 values are less than v.
+			return rMin + 1, rMin + t.gap + t.delta
+		}
+		rMin += t.gap
+	}
+	return s.n + 1, s.n + 1
+}
+
+// EstimatedRank returns the midpoint of the rank interval returned by Rank.
+func (s *Summary) EstimatedRank(v float64) int {
+	min, max := s.Rank(v)
+	return (min + max) / 2
+}
+
+// Combine returns a new Summary which contains the values of s and s2.
+// The epsilon of the result is the larger one of s and s2, and the other
+// options are the same as s.
+func (s *Summary) Combine(s2 *Summary) (*Summary, error) {
+	if s2 == nil {
+		return nil, errNilSummary
+	}
+	s.flush()
+	s2.flush()
+
+	epsilon := math.Max(s.epsilon, s2.epsilon)
+	merged := NewSummary(epsilon)
+	merged.bandCompression = s.bandCompression
+	merged.n = s.n + s2.n
+	merged.tuples = make([]tuple, 0, len(s.tuples)+len(s2.tuples))
+
+	// A tuple from one summary may be preceded by any of the values
+	// between the neighboring tuples of the other summary, so its delta
+	// is increased by the maximum uncertainty of the other summary.
+	// The minimum and maximum tuples of the result need no adjustment.
+	additionalDelta := int(math.Floor(2 * s2.epsilon * float64(s2.n)))
+	additionalDelta2 := int(math.Floor(2 * s.epsilon * float64(s.n)))
+	var i, j int
+	for i < len(s.tuples) && j < len(s2.tuples) {
+		var t tuple
+		if s.tuples[i].value < s2.tuples[j].value {
+			t = s.tuples[i]
+			if j > 0 {
+				t.delta += additionalDelta
+			}
+			i++
+		} else {
+			t = s2.tuples[j]
+			if i > 0 {
+				t.delta += additionalDelta2
+			}
+			j++
+		}
+		merged.tuples = append(merged.tuples, t)
+	}
+	merged.tuples = append(merged.tuples, s.tuples[i:]...)
+	merged.tuples = append(merged.tuples, s2.tuples[j:]...)
+
+	merged.compress()
+	return merged, nil
+}
+
+// Count returns the number of values added.
+func (s *Summary) Count() int { return s.n + len(s.buffer) }
+
+// NumTuples returns the number of tuples retained in the summary after
+// merging the buffered values.
+func (s *Summary) NumTuples() int {
+	s.flush()
+	return len(s.tuples)
+}
+
+// Epsilon returns the error bound of the summary.
+func (s *Summary) Epsilon() float64 { return s.epsilon }
+
+// Min returns the minimum value added.
+func (s *Summary) Min() (float64, error) {
+	s.flush()
+	if len(s.tuples) == 0 {
+		return 0, errNoValueAdded
+	}
+	return s.tuples[0].value, nil
+}
+
+// Max returns the maximum value added.
+func (s *Summary) Max() (float64, error) {
+	s.flush()
+	if len(s.tuples) == 0 {
+		return 0, errNoValueAdded
+	}
+	return s.tuples[len(s.tuples)-1].value, nil
+}
+
+// Reset removes all values while keeping epsilon.
+func (s *Summary) Reset() {
+	s.tuples = s.tuples[:0]
+	s.buffer = s.buffer[:0]
+	s.n = 0
+}
+
+// Validate checks the internal invariants of the summary and returns an
+// error describing the first violation found. It is intended for tests and
+// debugging. Buffered values are not merged before the check.
+func (s *Summary) Validate() error {
+	if len(s.buffer) >= s.compressingInterval {
+		return fmt.Errorf("buffer not flushed, len=%d, compressingInterval=%d", len(s.buffer), s.compressingInterval)
+	}
+	// an inserted tuple has the gap 1 in addition to the maximum delta.
+	maxGapDelta := int(math.Floor(2*s.epsilon*float64(s.n))) + 1
+	n := 0
+	for i := range s.tuples {
+		t := &s.tuples[i]
+		if i > 0 && t.value < s.tuples[i-1].value {
+			return fmt.Errorf("tuples not sorted, i=%d, value=%g, prev=%g", i, t.value, s.tuples[i-1].value)
+		}
+		if t.gap < 1 || t.delta < 0 {
+			return fmt.Errorf("invalid tuple, i=%d, gap=%d, delta=%d", i, t.gap, t.delta)
+		}
+		if t.gap+t.delta > maxGapDelta {
+			return fmt.Errorf("gap+delta exceeds bound, i=%d, gap=%d, delta=%d, bound=%d", i, t.gap, t.delta, maxGapDelta)
+		}
+		n += t.gap
+	}
+	if n != s.n {
+		return fmt.Errorf("sum of gaps mismatch, got=%d, want=%d", n, s.n)
+	}
+	return nil
+}
+
 func (s *Summary) compress() {
+	if s.bandCompression {
+		s.bandCompress()
+		return
+	}
 	threshold := int(math.Floor(2 * s.epsilon * float64(s.n)))
+	out := s.tuples[:0]
+	for _, t := range s.tuples {
+		out = appendCompressed(out, t, threshold)
+	}
+	s.tuples = out
+}
+
+// appendCompressed appends t to tuples after merging the preceding tuples
+// into t while their deltas are not less than the one of t and the merged
+// tuple stays within threshold. The first tuple, which holds the minimum
+// value, is never merged. tuples may share the backing array with the
+// source of t as long as the source is read ahead of the appended position.
+func appendCompressed(tuples []tuple, t tuple, threshold int) []tuple {
+	for len(tuples) > 1 {
+		t1 := &tuples[len(tuples)-1]
+		if t1.delta < t.delta || t1.gap+t.gap+t.delta >= threshold {
+			break
+		}
+		t.gap += t1.gap
+		tuples = tuples[:len(tuples)-1]
+	}
+	return append(tuples, t)
+}
+
+// bandCompress is COMPRESS in "Space-Efficient Online Computation of
+// Quantile Summaries" by Michael Greenwald and Sanjeev Khanna.
+//
+// Tuples are scanned from right to left. If the band of tuple i is not
+// greater than the one of its right neighbor, tuple i and its descendants,
+// which are the contiguous preceding tuples of smaller bands, are merged
+// into the right neighbor when the merged tuple stays within the error
+// bound. The first tuple, which holds the minimum value, is never merged.
+func (s *Summary) bandCompress() {
+	if len(s.tuples) < 3 {
+		return
+	}
+	p := int(math.Floor(2 * s.epsilon * float64(s.n)))
+	// Kept tuples are moved to the end of s.tuples, and w is the index
+	// of the right neighbor of tuple i in the result. Since w > i, the
+	// tuples not scanned yet are never overwritten.
+	w := len(s.tuples) - 1
 	for i := len(s.tuples) - 2; i >= 1; i-- {
-		for i < len(s.tuples)-1 && s.deleteIfNeeded(i, threshold) {
+		right := &s.tuples[w]
+		band := gkBand(s.tuples[i].delta, p)
+		if band <= gkBand(right.delta, p) {
+			start := i
+			gapSum := s.tuples[i].gap
+			for start > 1 && gkBand(s.tuples[start-1].delta, p) < band {
+				start--
+				gapSum += s.tuples[start].gap
+			}
+			if gapSum+right.gap+right.delta < p {
+				right.gap += gapSum
+				i = start
+				continue
+			}
 		}
+		w--
+		s.tuples[w] = s.tuples[i]
 	}
+	w--
+	s.tuples[w] = s.tuples[0]
+	n := copy(s.tuples, s.tuples[w:])
+	s.tuples = s.tuples[:n]
 }
 
-func (s *Summary) deleteIfNeeded(i, threshold int) bool {
-	t1, t2 := &s.tuples[i], &s.tuples[i+1]
-	if t1.delta >= t2.delta && t1.gap+t2.gap+t2.delta < threshold {
-		t2.gap += t1.gap
-		copy(s.tuples[i:], s.tuples[i+1:])
-		s.tuples = s.tuples[:len(s.tuples)-1]
-		return true
+// gkBand returns the band of delta for p = floor(2*epsilon*n). The band 0
+// is p itself and the band alpha >= 1 is the range
+// (p - 2^alpha - p mod 2^alpha, p - 2^(alpha-1) - p mod 2^(alpha-1)].
+// Tuples of higher bands have smaller deltas, that is, are older.
+func gkBand(delta, p int) int {
+	if delta >= p {
+		return 0
+	}
+	alpha := 1
+	for {
+		lower := p - 1<<alpha - p%(1<<alpha)
+		if delta > lower {
+			return alpha
+		}
+		alpha++
 	}
-	return false
 }
@@ -24,10 +24,14 @@ func (s *SummaryNaiveImpl) Add(value float64) {
 
 func (s *SummaryNaiveImpl) Quantile(q float64) (float64, error) {
 	if len(s.values) == 0 {
-		return 0, errors.New("no value added")
+		return 0, errNoValueAdded
 	}
 
 	i := int(float64(len(s.values)) * q)
+	if i == len(s.values) {
+		// q is 1
+		i--
+	}
 	if i < 0 || i >= len(s.values) {
 		return 0, errors.New("quantile out of range")
 	}
@@ -41,6 +45,26 @@ func (s *SummaryNaiveImpl) Rank(value float64) int {
 	return i + 1
 }
 
+func (s *SummaryNaiveImpl) Count() int { return len(s.values) }
+
+func (s *SummaryNaiveImpl) Min() (float64, error) {
+	if len(s.values) == 0 {
+		return 0, errNoValueAdded
+	}
+	return s.values[0], nil
+}
+
+func (s *SummaryNaiveImpl) Max() (float64, error) {
+	if len(s.values) == 0 {
+		return 0, errNoValueAdded
+	}
+	return s.values[len(s.values)-1], nil
+}
+
+func (s *SummaryNaiveImpl) Reset() {
+	s.values = s.values[:0]
+}
+
 func (s *SummaryNaiveImpl) Combine(s2 *SummaryNaiveImpl) *SummaryNaiveImpl {
 	values := make([]float64, 0, len(s.values)+len(s2.values))
 	var i, j int
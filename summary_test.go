@@ -3,10 +3,9 @@ package main
 import (
 	"math"
 	"math/rand"
-	"os"
+	"sort"
 	"strconv"
 	"testing"
-	"time"
 
 	"golang.org/x/exp/slices"
 	"pgregory.net/rapid"
@@ -44,132 +43,360 @@ func TestSummary(t *testing.T) {
 	}
 }
 
-func TestSummary_CompareToNaive(t *testing.T) {
-	const epsilon = 0.01
+func TestNewSummaryE(t *testing.T) {
 	testCases := []struct {
-		inputs  []float64
-		pValues []float64
-		want    []float64
+		epsilon float64
+		want    error
 	}{
-		{
-			inputs:  []float64{12, 6, 10, 1},
-			pValues: []float64{0, 0.25, 0.5, 0.6, 0.75, 0.999},
-		},
+		{epsilon: 0.01, want: nil},
+		{epsilon: 0.5, want: nil},
+		{epsilon: 0, want: ErrInvalidEpsilon},
+		{epsilon: -0.01, want: ErrInvalidEpsilon},
+		{epsilon: 0.51, want: ErrInvalidEpsilon},
+		{epsilon: math.NaN(), want: ErrInvalidEpsilon},
 	}
-	for caseIdx, ts := range testCases {
-		s := NewSummary(epsilon)
-		sRef := &SummaryNaiveImpl{}
-		for _, v := range ts.inputs {
-			s.Add(v)
-			sRef.Add(v)
+	for _, tc := range testCases {
+		s, err := NewSummaryE(tc.epsilon)
+		if err != tc.want {
+			t.Errorf("error mismatch, epsilon=%g, got=%v, want=%v", tc.epsilon, err, tc.want)
 		}
-		for _, p := range ts.pValues {
-			v, err := s.Quantile(p)
-			if err != nil {
-				t.Fatalf("quantile: case=%d, p=%g, err=%s", caseIdx, p, err)
+		if err == nil && s == nil {
+			t.Errorf("summary must not be nil, epsilon=%g", tc.epsilon)
+		}
+	}
+}
+
+func TestSummary_Accessors(t *testing.T) {
+	s := NewSummary(0.01)
+	if got, want := s.Epsilon(), 0.01; got != want {
+		t.Errorf("epsilon mismatch, got=%g, want=%g", got, want)
+	}
+	if got, want := s.NumTuples(), 0; got != want {
+		t.Errorf("numTuples mismatch, got=%d, want=%d", got, want)
+	}
+	for i := 0; i < 10000; i++ {
+		s.Add(float64(i))
+	}
+	if got, want := s.Count(), 10000; got != want {
+		t.Errorf("count mismatch, got=%d, want=%d", got, want)
+	}
+	if got := s.NumTuples(); got == 0 || got >= s.Count() {
+		t.Errorf("numTuples must be in the range (0, count), got=%d, count=%d", got, s.Count())
+	}
+}
+
+func TestSummary_Validate(t *testing.T) {
+	newSummary := func() *Summary {
+		s := NewSummary(0.01)
+		for i := 0; i < 1000; i++ {
+			s.Add(float64(i))
+		}
+		if err := s.Validate(); err != nil {
+			t.Fatalf("valid summary must pass, err=%s", err)
+		}
+		return s
+	}
+
+	testCases := []struct {
+		name    string
+		corrupt func(s *Summary)
+	}{
+		{name: "n", corrupt: func(s *Summary) { s.n++ }},
+		{name: "sorted", corrupt: func(s *Summary) { s.tuples[1].value, s.tuples[2].value = s.tuples[2].value, s.tuples[1].value }},
+		{name: "gapDelta", corrupt: func(s *Summary) { s.tuples[1].delta = s.n }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newSummary()
+			tc.corrupt(s)
+			if err := s.Validate(); err == nil {
+				t.Errorf("corrupted summary must fail")
 			}
-			vRef, err := sRef.Quantile(p)
+		})
+	}
+}
+
+func TestSummary_PropertyQuantilesSameAsQuantile(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		seed := rapid.Int64().Draw(t, "seed")
+		s := NewSummary(0.01)
+		rnd := rand.New(rand.NewSource(seed))
+		n := 1 + rnd.Intn(5000)
+		for i := 0; i < n; i++ {
+			s.Add(rnd.Float64())
+			checkValid(t, s)
+		}
+		ps := rapid.SliceOf(rapid.SampledFrom([]float64{0, 0.5, 0.9, 0.99, 0.999, 1})).Draw(t, "ps")
+		ps = append(ps, rapid.SliceOf(rapid.Float64Range(0, 1)).Draw(t, "morePs")...)
+
+		got, err := s.Quantiles(ps)
+		if err != nil {
+			t.Fatalf("quantiles: err=%s", err)
+		}
+		for i, p := range ps {
+			want, err := s.Quantile(p)
 			if err != nil {
-				t.Fatalf("ref quantile: case=%d, p=%g, err=%s", caseIdx, p, err)
+				t.Fatalf("quantile: p=%g, err=%s", p, err)
 			}
-			if got, want := v, vRef; got != want {
-				gotRank := sRef.Rank(v)
-				wantRank := int(p*float64(len(ts.inputs)) + 1)
-				margin := int(math.Ceil(epsilon * float64(len(ts.inputs))))
-				wantRankMin := wantRank - margin
-				wantRankMax := wantRank + margin
-				if gotRank < wantRankMin || gotRank > wantRankMax {
-					t.Errorf("result mismatch and rank out of range, p=%g, got=%g, want=%g, gotRank=%d, wantRank=%d, wantRankMin=%d, wantRankMax=%d",
-						p, got, want, gotRank, wantRank, wantRankMin, wantRankMax)
-				}
+			if got[i] != want {
+				t.Fatalf("quantile mismatch, p=%g, got=%g, want=%g", p, got[i], want)
 			}
 		}
+	})
+}
+
+func TestSummary_QuantilesEvenlySpaced(t *testing.T) {
+	s := NewSummary(0.01)
+	for i := 1; i <= 5; i++ {
+		s.Add(float64(i))
+	}
+	got, err := s.QuantilesEvenlySpaced(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{1, 3, 5}; !slices.Equal(got, want) {
+		t.Errorf("quantiles mismatch, got=%v, want=%v", got, want)
+	}
+
+	if _, err := s.QuantilesEvenlySpaced(1); err != errTooFewEvenlySpaced {
+		t.Errorf("error mismatch, got=%v, want=%v", err, errTooFewEvenlySpaced)
+	}
+	if _, err := s.Quantiles([]float64{1.1}); err != errNormalizedRankOutOfBounds {
+		t.Errorf("error mismatch, got=%v, want=%v", err, errNormalizedRankOutOfBounds)
+	}
+	if _, err := NewSummary(0.01).Quantiles([]float64{0.5}); err != errNoValueAdded {
+		t.Errorf("error mismatch, got=%v, want=%v", err, errNoValueAdded)
 	}
 }
 
-func TestSummary_CompareToNaiveRandom(t *testing.T) {
-	var seed int64
-	seedEnv := os.Getenv("SEED")
-	if seedEnv != "" {
-		var err error
-		seed, err = strconv.ParseInt(seedEnv, 10, 64)
-		if err != nil {
-			t.Fatalf("environment variable SEED must be an int64 value, got=%q", seedEnv)
-		}
-	} else {
-		seed = time.Now().UnixNano()
+func TestSummary_Combine(t *testing.T) {
+	s1 := NewSummary(0.01)
+	for _, v := range []float64{1, 5234, 9999, 5234} {
+		s1.Add(v)
+	}
+	s2 := NewSummary(0.02)
+	for _, v := range []float64{12, 6, 10, 1} {
+		s2.Add(v)
 	}
 
-	const epsilon = 0.01
-	s := NewSummary(epsilon)
-	sRef := &SummaryNaiveImpl{}
-	rnd := rand.New(rand.NewSource(seed))
-	n := 100 + rnd.Intn(1000)
-	for i := 0; i < n; i++ {
-		v := rnd.Float64()
-		s.Add(v)
-		sRef.Add(v)
+	s, err := s1.Combine(s2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Count(), 8; got != want {
+		t.Errorf("n mismatch, got=%d, want=%d", got, want)
+	}
+	if got, want := s.epsilon, 0.02; got != want {
+		t.Errorf("epsilon mismatch, got=%g, want=%g", got, want)
 	}
 
-	pValues := []float64{0, 0.25, 0.5, 0.75, 0.99, 0.999, 0.9999}
-	for _, p := range pValues {
+	pValues := []float64{0, 0.25, 0.5, 0.75, 1}
+	want := []float64{1, 6, 12, 5234, 9999}
+	got := make([]float64, len(pValues))
+	for i, p := range pValues {
 		v, err := s.Quantile(p)
 		if err != nil {
-			t.Fatalf("quantile: seed=%d, p=%g, err=%s", seed, p, err)
+			t.Fatalf("quantile: p=%g, err=%s", p, err)
 		}
-		vRef, err := sRef.Quantile(p)
-		if err != nil {
-			t.Fatalf("ref quantile: seed=%d, p=%g, err=%s", seed, p, err)
-		}
-		if got, want := v, vRef; got != want {
-			gotRank := sRef.Rank(v)
-			wantRank := int(p*float64(n) + 1)
-			margin := int(math.Ceil(epsilon * float64(n)))
-			wantRankMin := wantRank - margin
-			wantRankMax := wantRank + margin
-			if gotRank < wantRankMin || gotRank > wantRankMax {
-				t.Errorf("result mismatch and rank out of range, seed=%d, p=%g, got=%g, want=%g, gotRank=%d, wantRank=%d, wantRankMin=%d, wantRankMax=%d",
-					seed, p, got, want, gotRank, wantRank, wantRankMin, wantRankMax)
-			}
+		got[i] = v
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("result mismatch, got=%v, want=%v", got, want)
+	}
+
+	if _, err := s1.Combine(nil); err != errNilSummary {
+		t.Errorf("error mismatch, got=%v, want=%v", err, errNilSummary)
+	}
+}
+
+func TestSummary_Rank(t *testing.T) {
+	s := NewSummary(0.01)
+	for _, v := range []float64{12, 6, 10, 1} {
+		s.Add(v)
+	}
+	testCases := []struct {
+		value   float64
+		wantMin int
+		wantMax int
+	}{
+		{value: 0, wantMin: 1, wantMax: 1},
+		{value: 1, wantMin: 1, wantMax: 1},
+		{value: 6, wantMin: 2, wantMax: 2},
+		{value: 7, wantMin: 3, wantMax: 3},
+		{value: 12, wantMin: 4, wantMax: 4},
+		{value: 13, wantMin: 5, wantMax: 5},
+	}
+	for _, tc := range testCases {
+		gotMin, gotMax := s.Rank(tc.value)
+		if gotMin != tc.wantMin || gotMax != tc.wantMax {
+			t.Errorf("rank mismatch, value=%g, got=[%d, %d], want=[%d, %d]", tc.value, gotMin, gotMax, tc.wantMin, tc.wantMax)
+		}
+		if got, want := s.EstimatedRank(tc.value), tc.wantMin; got != want {
+			t.Errorf("estimated rank mismatch, value=%g, got=%d, want=%d", tc.value, got, want)
 		}
 	}
 }
 
-func TestSummary_PropertyCompareToNaive(t *testing.T) {
+func TestSummary_PropertyRankInterval(t *testing.T) {
 	rapid.Check(t, func(t *rapid.T) {
 		seed := rapid.Int64().Draw(t, "seed")
 		const epsilon = 0.01
 		s := NewSummary(epsilon)
 		sRef := &SummaryNaiveImpl{}
 		rnd := rand.New(rand.NewSource(seed))
-		n := 100 + rnd.Intn(1000)
+		n := 100 + rnd.Intn(10000)
 		for i := 0; i < n; i++ {
 			v := rnd.Float64()
 			s.Add(v)
+			checkValid(t, s)
 			sRef.Add(v)
 		}
 
-		pValues := []float64{0, 0.25, 0.5, 0.75, 0.99, 0.999, 0.9999}
-		for _, p := range pValues {
-			v, err := s.Quantile(p)
-			if err != nil {
-				t.Fatalf("quantile: p=%g, err=%s", p, err)
+		for i := 0; i < 10; i++ {
+			v := rnd.Float64()
+			gotMin, gotMax := s.Rank(v)
+			want := sRef.Rank(v)
+			if want < gotMin || want > gotMax {
+				t.Fatalf("rank out of range, v=%g, got=[%d, %d], want=%d", v, gotMin, gotMax, want)
 			}
-			vRef, err := sRef.Quantile(p)
-			if err != nil {
-				t.Fatalf("ref quantile: p=%g, err=%s", p, err)
+			if maxWidth := int(2*epsilon*float64(n)) + 1; gotMax-gotMin > maxWidth {
+				t.Fatalf("rank interval too wide, v=%g, got=[%d, %d], maxWidth=%d", v, gotMin, gotMax, maxWidth)
 			}
-			if got, want := v, vRef; got != want {
-				gotRank := sRef.Rank(v)
-				wantRank := int(p*float64(n) + 1)
-				margin := int(math.Ceil(epsilon * float64(n)))
-				wantRankMin := wantRank - margin
-				wantRankMax := wantRank + margin
-				if gotRank < wantRankMin || gotRank > wantRankMax {
-					t.Fatalf("result mismatch and rank out of range, p=%g, got=%g, want=%g, gotRank=%d, wantRank=%d, wantRankMin=%d, wantRankMax=%d",
-						p, got, want, gotRank, wantRank, wantRankMin, wantRankMax)
+		}
+	})
+}
+
+func BenchmarkSummary_Add(b *testing.B) {
+	impls := []struct {
+		name string
+		add  func(s *Summary, v float64)
+	}{
+		{name: "buffered", add: (*Summary).Add},
+		{name: "unbuffered", add: addUnbuffered},
+	}
+	for _, impl := range impls {
+		for _, n := range []int{1e6, 1e7, 1e8} {
+			b.Run(impl.name+"/n="+strconv.Itoa(n), func(b *testing.B) {
+				if n > 1e7 && testing.Short() {
+					b.Skip("skipping 1e8 inserts in short mode")
 				}
+				for i := 0; i < b.N; i++ {
+					rnd := rand.New(rand.NewSource(1))
+					s := NewSummary(0.01)
+					for j := 0; j < n; j++ {
+						impl.add(s, rnd.Float64())
+					}
+				}
+				b.SetBytes(int64(n * 8))
+			})
+		}
+	}
+}
+
+// addUnbuffered adds v to s in the way before inserts were buffered, that
+// is, by a binary search and a copy insertion, and compresses the tuples
+// every compressingInterval values by deleting tuples one by one. It is
+// the baseline of BenchmarkSummary_Add.
+func addUnbuffered(s *Summary, v float64) {
+	i := sort.Search(len(s.tuples), func(i int) bool { return s.tuples[i].value >= v })
+	delta := 0
+	if i > 0 && i < len(s.tuples) {
+		delta = int(math.Floor(2 * s.epsilon * float64(s.n)))
+	}
+	t := tuple{value: v, gap: 1, delta: delta}
+
+	if i < len(s.tuples) {
+		s.tuples = append(s.tuples, tuple{})
+		copy(s.tuples[i+1:], s.tuples[i:])
+		s.tuples[i] = t
+	} else {
+		s.tuples = append(s.tuples, t)
+	}
+	s.n++
+
+	if s.n%s.compressingInterval == 0 {
+		threshold := int(math.Floor(2 * s.epsilon * float64(s.n)))
+		for i := len(s.tuples) - 2; i >= 1; i-- {
+			for i < len(s.tuples)-1 {
+				t1, t2 := &s.tuples[i], &s.tuples[i+1]
+				if t1.delta < t2.delta || t1.gap+t2.gap+t2.delta >= threshold {
+					break
+				}
+				t2.gap += t1.gap
+				copy(s.tuples[i:], s.tuples[i+1:])
+				s.tuples = s.tuples[:len(s.tuples)-1]
+			}
+		}
+	}
+}
+
+func TestSummary_PropertyBandCompression(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		seed := rapid.Int64().Draw(t, "seed")
+		epsilon := rapid.SampledFrom([]float64{0.1, 0.05, 0.01}).Draw(t, "epsilon")
+		order := rapid.SampledFrom([]string{"random", "ascending", "descending", "duplicates"}).Draw(t, "order")
+		s := NewSummary(epsilon, WithBandCompression())
+		sRef := &SummaryNaiveImpl{}
+		rnd := rand.New(rand.NewSource(seed))
+		n := 100 + rnd.Intn(20000)
+		for i := 0; i < n; i++ {
+			var v float64
+			switch order {
+			case "random":
+				v = rnd.Float64()
+			case "ascending":
+				v = float64(i)
+			case "descending":
+				v = float64(n - i)
+			case "duplicates":
+				v = float64(rnd.Intn(10))
+			}
+			s.Add(v)
+			checkValid(t, s)
+			sRef.Add(v)
+
+			// The space bound is 11/(2*epsilon)*log(2*epsilon*n) tuples
+			// in the paper, checked when the buffer has been merged.
+			if len(s.buffer) == 0 && 2*epsilon*float64(s.n) >= 2 {
+				bound := 11 / (2 * epsilon) * math.Log2(2*epsilon*float64(s.n))
+				if got := len(s.tuples); float64(got) > bound {
+					t.Fatalf("too many tuples, n=%d, got=%d, bound=%g", s.n, got, bound)
+				}
+			}
+		}
+
+		for i := 0; i < 10; i++ {
+			v := sRef.values[rnd.Intn(n)]
+			gotMin, gotMax := s.Rank(v)
+			want := sRef.Rank(v)
+			if want < gotMin || want > gotMax {
+				t.Fatalf("rank out of range, v=%g, got=[%d, %d], want=%d", v, gotMin, gotMax, want)
+			}
+			if maxWidth := int(2*epsilon*float64(n)) + 1; gotMax-gotMin > maxWidth {
+				t.Fatalf("rank interval too wide, v=%g, got=[%d, %d], maxWidth=%d", v, gotMin, gotMax, maxWidth)
 			}
 		}
 	})
 }
+
+func TestGKBand(t *testing.T) {
+	// p = 10: band 0 is {10}, band 1 is (8, 9], band 2 is (4, 8],
+	// band 3 is (0, 4] and band 4 is (-16, 0].
+	testCases := []struct {
+		delta int
+		want  int
+	}{
+		{delta: 10, want: 0},
+		{delta: 9, want: 1},
+		{delta: 8, want: 2},
+		{delta: 5, want: 2},
+		{delta: 4, want: 3},
+		{delta: 1, want: 3},
+		{delta: 0, want: 4},
+	}
+	for _, tc := range testCases {
+		if got := gkBand(tc.delta, 10); got != tc.want {
+			t.Errorf("band mismatch, delta=%d, got=%d, want=%d", tc.delta, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// TDigest is a merging t-digest, which is described in
+// "Computing Extremely Accurate Quantiles Using t-Digests" by Ted Dunning
+// and Otmar Ertl.
+type TDigest struct {
+	compression float64
+	scale       TDigestScale
+
+	// state variables
+
+	totalWeight    float64 // weight of centroids and buffer
+	unmergedWeight float64 // weight of buffer
+	minValue       float64
+	maxValue       float64
+
+	// objects
+
+	centroids  []centroid // merged centroids sorted by mean
+	buffer     []centroid // centroids not merged yet
+	bufferSize int
+}
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// TDigestScale is the scale function which limits the size of centroids.
+type TDigestScale int
+
+const (
+	// TDigestScaleK1 is k1(q) = δ/(2π) asin(2q-1), which makes the
+	// accuracy at the tails better than at the middle.
+	TDigestScaleK1 TDigestScale = iota
+	// TDigestScaleK2 is k2(q) = δ/Z(n) log(q/(1-q)) where
+	// Z(n) = 4 log(n/δ) + 24, which makes the accuracy at the tails
+	// even better than TDigestScaleK1.
+	TDigestScaleK2
+)
+
+const tdigestBufferMultiplier = 5
+
+// NewTDigest creates a TDigest.
+// @param compression Controls the size and error of the digest. The number
+// of centroids is about compression. 100 is a typical value.
+// @param scale The scale function.
+func NewTDigest(compression float64, scale TDigestScale) *TDigest {
+	if compression <= 0 {
+		panic("compression must be positive")
+	}
+	if scale != TDigestScaleK1 && scale != TDigestScaleK2 {
+		panic("invalid scale function")
+	}
+	return &TDigest{
+		compression: compression,
+		scale:       scale,
+		minValue:    math.NaN(),
+		maxValue:    math.NaN(),
+		bufferSize:  tdigestBufferMultiplier * int(math.Ceil(compression)),
+	}
+}
+
+// Add adds a value with weight 1.
+func (d *TDigest) Add(v float64) {
+	d.AddWeighted(v, 1)
+}
+
+// AddWeighted adds a value with weight, which is the same as adding v
+// weight times. It panics with ErrInvalidWeight if weight is not positive.
+func (d *TDigest) AddWeighted(v float64, weight int) {
+	if math.IsNaN(v) {
+		panic("cannot add NaN")
+	}
+	if weight <= 0 {
+		panic(ErrInvalidWeight)
+	}
+	d.add(centroid{mean: v, weight: float64(weight)}, v, v)
+}
+
+func (d *TDigest) add(c centroid, min, max float64) {
+	if d.empty() || min < d.minValue {
+		d.minValue = min
+	}
+	if d.empty() || max > d.maxValue {
+		d.maxValue = max
+	}
+	d.buffer = append(d.buffer, c)
+	d.unmergedWeight += c.weight
+	d.totalWeight += c.weight
+	if len(d.buffer) >= d.bufferSize {
+		d.flush()
+	}
+}
+
+// Quantile returns the approximate value at the normalized rank q.
+func (d *TDigest) Quantile(q float64) (float64, error) {
+	if d.empty() {
+		return 0, errEmptySketch
+	}
+	if err := checkNormalizedRankBounds(q); err != nil {
+		return 0, err
+	}
+	d.flush()
+
+	cs := d.centroids
+	n := len(cs)
+	if n == 1 {
+		return cs[0].mean, nil
+	}
+
+	index := q * d.totalWeight
+	if index < 1 {
+		return d.minValue, nil
+	}
+	// interpolate between min and the center of the first centroid
+	if first := cs[0]; first.weight > 1 && index < first.weight/2 {
+		return d.minValue + (index-1)/(first.weight/2-1)*(first.mean-d.minValue), nil
+	}
+	if index > d.totalWeight-1 {
+		return d.maxValue, nil
+	}
+	// interpolate between the center of the last centroid and max
+	if last := cs[n-1]; last.weight > 1 && d.totalWeight-index <= last.weight/2 {
+		return d.maxValue - (d.totalWeight-index-1)/(last.weight/2-1)*(d.maxValue-last.mean), nil
+	}
+
+	// between the centers of two adjacent centroids
+	weightSoFar := cs[0].weight / 2
+	for i := 0; i < n-1; i++ {
+		dw := (cs[i].weight + cs[i+1].weight) / 2
+		if weightSoFar+dw > index {
+			// a singleton centroid has all its weight at the center.
+			leftUnit := 0.0
+			if cs[i].weight == 1 {
+				if index-weightSoFar < 0.5 {
+					return cs[i].mean, nil
+				}
+				leftUnit = 0.5
+			}
+			rightUnit := 0.0
+			if cs[i+1].weight == 1 {
+				if weightSoFar+dw-index <= 0.5 {
+					return cs[i+1].mean, nil
+				}
+				rightUnit = 0.5
+			}
+			z1 := index - weightSoFar - leftUnit
+			z2 := weightSoFar + dw - index - rightUnit
+			return weightedAverage(cs[i].mean, z2, cs[i+1].mean, z1), nil
+		}
+		weightSoFar += dw
+	}
+	return d.maxValue, nil
+}
+
+// CDF returns the approximate fraction of values less than or equal to v.
+// Values equal to the mean of a centroid count half of its weight.
+func (d *TDigest) CDF(v float64) (float64, error) {
+	return d.cdf(v, 0.5)
+}
+
+// Rank returns the approximate fraction of values less than or equal to v.
+// Unlike CDF, values equal to the mean of a centroid count all of its
+// weight.
+func (d *TDigest) Rank(v float64) (float64, error) {
+	return d.cdf(v, 1)
+}
+
+// cdf returns the approximate fraction of values less than v plus
+// eqFraction of the values equal to v.
+func (d *TDigest) cdf(v, eqFraction float64) (float64, error) {
+	if d.empty() {
+		return 0, errEmptySketch
+	}
+	if math.IsNaN(v) {
+		return 0, errNaNRankItem
+	}
+	d.flush()
+
+	if v < d.minValue {
+		return 0, nil
+	}
+	if v > d.maxValue {
+		return 1, nil
+	}
+	cs := d.centroids
+	n := len(cs)
+	if n == 1 {
+		if d.maxValue == d.minValue {
+			return eqFraction, nil
+		}
+		return (v - d.minValue) / (d.maxValue - d.minValue), nil
+	}
+
+	// before the center of the first centroid
+	if first := cs[0]; v < first.mean {
+		if v == d.minValue {
+			return eqFraction / d.totalWeight, nil
+		}
+		return (1 + (v-d.minValue)/(first.mean-d.minValue)*(first.weight/2-1)) / d.totalWeight, nil
+	}
+	// after the center of the last centroid
+	if last := cs[n-1]; v > last.mean {
+		if v == d.maxValue {
+			return 1 - (1-eqFraction)/d.totalWeight, nil
+		}
+		return 1 - (1+(d.maxValue-v)/(d.maxValue-last.mean)*(last.weight/2-1))/d.totalWeight, nil
+	}
+
+	weightSoFar := 0.0
+	for i := 0; i < n-1; i++ {
+		if cs[i].mean == v {
+			// sum the weights of all centroids with the same mean
+			dw := 0.0
+			for ; i < n && cs[i].mean == v; i++ {
+				dw += cs[i].weight
+			}
+			return (weightSoFar + dw*eqFraction) / d.totalWeight, nil
+		}
+		if v < cs[i+1].mean {
+			// a singleton centroid has all its weight at the center.
+			leftExcluded, rightExcluded := 0.0, 0.0
+			if cs[i].weight == 1 {
+				if cs[i+1].weight == 1 {
+					return (weightSoFar + 1) / d.totalWeight, nil
+				}
+				leftExcluded = 0.5
+			} else if cs[i+1].weight == 1 {
+				rightExcluded = 0.5
+			}
+			dw := (cs[i].weight+cs[i+1].weight)/2 - leftExcluded - rightExcluded
+			base := weightSoFar + cs[i].weight/2 + leftExcluded
+			return (base + dw*(v-cs[i].mean)/(cs[i+1].mean-cs[i].mean)) / d.totalWeight, nil
+		}
+		weightSoFar += cs[i].weight
+	}
+	// v is equal to the mean of the last centroid
+	return (weightSoFar + cs[n-1].weight*eqFraction) / d.totalWeight, nil
+}
+
+// Count returns the total weight of added values.
+func (d *TDigest) Count() int { return int(d.totalWeight) }
+
+// Min returns the minimum value added.
+func (d *TDigest) Min() (float64, error) {
+	if d.empty() {
+		return 0, errEmptySketch
+	}
+	return d.minValue, nil
+}
+
+// Max returns the maximum value added.
+func (d *TDigest) Max() (float64, error) {
+	if d.empty() {
+		return 0, errEmptySketch
+	}
+	return d.maxValue, nil
+}
+
+// Merge merges o into d.
+func (d *TDigest) Merge(o *TDigest) {
+	if o.empty() {
+		return
+	}
+	// copy first in case o == d
+	cs := make([]centroid, 0, len(o.centroids)+len(o.buffer))
+	cs = append(cs, o.centroids...)
+	cs = append(cs, o.buffer...)
+	min, max := o.minValue, o.maxValue
+	for _, c := range cs {
+		d.add(c, min, max)
+	}
+	d.flush()
+}
+
+// Reset removes all values while keeping the compression and the scale
+// function.
+func (d *TDigest) Reset() {
+	*d = *NewTDigest(d.compression, d.scale)
+}
+
+func (d *TDigest) empty() bool { return d.totalWeight == 0 }
+
+// flush merges the buffer into the centroids.
+func (d *TDigest) flush() {
+	if d.unmergedWeight == 0 {
+		return
+	}
+
+	cs := append(d.buffer, d.centroids...)
+	sort.Slice(cs, func(i, j int) bool { return cs[i].mean < cs[j].mean })
+
+	normalizer := d.scale.normalizer(d.compression, d.totalWeight)
+	out := d.centroids[:0]
+	cur := cs[0]
+	weightSoFar := 0.0
+	for i := 1; i < len(cs); i++ {
+		proposedWeight := cur.weight + cs[i].weight
+		q0 := weightSoFar / d.totalWeight
+		q2 := (weightSoFar + proposedWeight) / d.totalWeight
+		maxWeight := d.totalWeight * math.Min(d.scale.max(q0, normalizer), d.scale.max(q2, normalizer))
+		// keep the first and the last centroids singletons for accuracy
+		// at the tails.
+		if proposedWeight <= maxWeight && i != 1 && i != len(cs)-1 {
+			cur.mean += (cs[i].mean - cur.mean) * cs[i].weight / proposedWeight
+			cur.weight = proposedWeight
+		} else {
+			weightSoFar += cur.weight
+			out = append(out, cur)
+			cur = cs[i]
+		}
+	}
+	out = append(out, cur)
+
+	d.centroids = out
+	d.buffer = cs[:0]
+	d.unmergedWeight = 0
+}
+
+func (s TDigestScale) normalizer(compression, n float64) float64 {
+	if s == TDigestScaleK1 {
+		return compression / (2 * math.Pi)
+	}
+	return compression / (4*math.Log(n/compression) + 24)
+}
+
+// max returns the maximum normalized weight of a centroid at the
+// normalized rank q so that its size in k scale is at most one.
+func (s TDigestScale) max(q, normalizer float64) float64 {
+	if s == TDigestScaleK1 {
+		return 2 * math.Sin(0.5/normalizer) * math.Sqrt(q*(1-q))
+	}
+	return q * (1 - q) / normalizer
+}
+
+func weightedAverage(x1, w1, x2, w2 float64) float64 {
+	if x1 > x2 {
+		x1, w1, x2, w2 = x2, w2, x1, w1
+	}
+	v := (x1*w1 + x2*w2) / (w1 + w2)
+	// guard against rounding errors
+	return math.Max(x1, math.Min(v, x2))
+}
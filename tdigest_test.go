@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestTDigest(t *testing.T) {
+	for _, scale := range []TDigestScale{TDigestScaleK1, TDigestScaleK2} {
+		d := NewTDigest(100, scale)
+		for _, v := range []float64{12, 6, 10, 1} {
+			d.Add(v)
+		}
+		pValues := []float64{0, 0.25, 0.5, 0.75, 1}
+		want := []float64{1, 6, 10, 12, 12}
+		got := make([]float64, len(pValues))
+		for i, p := range pValues {
+			v, err := d.Quantile(p)
+			if err != nil {
+				t.Fatalf("quantile: scale=%d, p=%g, err=%s", scale, p, err)
+			}
+			got[i] = v
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("result mismatch, scale=%d, got=%v, want=%v", scale, got, want)
+		}
+	}
+}
+
+func TestTDigest_CDF(t *testing.T) {
+	d := NewTDigest(100, TDigestScaleK2)
+	for _, v := range []float64{12, 6, 10, 1} {
+		d.Add(v)
+	}
+	testCases := []struct {
+		value float64
+		want  float64
+	}{
+		{value: 0, want: 0},
+		{value: 1, want: 0.125},
+		{value: 5, want: 0.25},
+		{value: 6, want: 0.375},
+		{value: 10, want: 0.625},
+		{value: 12, want: 0.875},
+		{value: 13, want: 1},
+	}
+	for _, tc := range testCases {
+		got, err := d.CDF(tc.value)
+		if err != nil {
+			t.Fatalf("cdf: value=%g, err=%s", tc.value, err)
+		}
+		if got != tc.want {
+			t.Errorf("cdf mismatch, value=%g, got=%g, want=%g", tc.value, got, tc.want)
+		}
+	}
+	if _, err := d.CDF(math.NaN()); err != errNaNRankItem {
+		t.Errorf("error mismatch, got=%v, want=%v", err, errNaNRankItem)
+	}
+}
+
+func TestTDigest_Rank(t *testing.T) {
+	d := NewTDigest(100, TDigestScaleK2)
+	for _, v := range []float64{12, 6, 10, 1} {
+		d.Add(v)
+	}
+	testCases := []struct {
+		value float64
+		want  float64
+	}{
+		{value: 0, want: 0},
+		{value: 1, want: 0.25},
+		{value: 5, want: 0.25},
+		{value: 6, want: 0.5},
+		{value: 10, want: 0.75},
+		{value: 12, want: 1},
+		{value: 13, want: 1},
+	}
+	for _, tc := range testCases {
+		got, err := d.Rank(tc.value)
+		if err != nil {
+			t.Fatalf("rank: value=%g, err=%s", tc.value, err)
+		}
+		if got != tc.want {
+			t.Errorf("rank mismatch, value=%g, got=%g, want=%g", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestTDigest_AddWeighted(t *testing.T) {
+	d := NewTDigest(100, TDigestScaleK2)
+	dRef := NewTDigest(100, TDigestScaleK2)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		v := rnd.Float64()
+		w := 1 + rnd.Intn(10)
+		d.AddWeighted(v, w)
+		for j := 0; j < w; j++ {
+			dRef.Add(v)
+		}
+	}
+	if got, want := d.Count(), dRef.Count(); got != want {
+		t.Errorf("count mismatch, got=%d, want=%d", got, want)
+	}
+	for _, p := range []float64{0.01, 0.25, 0.5, 0.75, 0.99} {
+		got, err := d.Quantile(p)
+		if err != nil {
+			t.Fatalf("quantile: p=%g, err=%s", p, err)
+		}
+		want, err := dRef.Quantile(p)
+		if err != nil {
+			t.Fatalf("ref quantile: p=%g, err=%s", p, err)
+		}
+		if math.Abs(got-want) > 0.01 {
+			t.Errorf("result mismatch, p=%g, got=%g, want=%g", p, got, want)
+		}
+	}
+}
+
+func TestTDigest_CentroidSize(t *testing.T) {
+	for _, scale := range []TDigestScale{TDigestScaleK1, TDigestScaleK2} {
+		const compression = 100
+		d := NewTDigest(compression, scale)
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < 100000; i++ {
+			d.Add(rnd.NormFloat64())
+		}
+		d.flush()
+		if got, max := len(d.centroids), 2*compression; got > max {
+			t.Errorf("too many centroids, scale=%d, got=%d, max=%d", scale, got, max)
+		}
+
+		// The size of each centroid in k scale must be at most one.
+		const tolerance = 1e-9
+		normalizer := scale.normalizer(compression, d.totalWeight)
+		weightSoFar := 0.0
+		for i, c := range d.centroids {
+			q0 := weightSoFar / d.totalWeight
+			weightSoFar += c.weight
+			q1 := weightSoFar / d.totalWeight
+			if c.weight == 1 {
+				continue
+			}
+			if size := tdigestK(scale, q1, normalizer) - tdigestK(scale, q0, normalizer); size > 1+tolerance {
+				t.Errorf("centroid too large, scale=%d, i=%d, weight=%g, size=%g", scale, i, c.weight, size)
+			}
+		}
+	}
+}
+
+// tdigestK returns the value of the normalized rank q in the scale. The
+// flush uses TDigestScale.max derived from it instead, so it is only used
+// to check the sizes of centroids.
+func tdigestK(scale TDigestScale, q, normalizer float64) float64 {
+	if scale == TDigestScaleK1 {
+		return normalizer * math.Asin(2*q-1)
+	}
+	return normalizer * math.Log(q/(1-q))
+}
+
+// tdigestRankErrorBound returns the allowed normalized rank error at the
+// normalized rank p for a digest with compression 100. Centroids are
+// larger around the median, so the error is too.
+func tdigestRankErrorBound(p float64) float64 {
+	return 0.05 * math.Sqrt(p*(1-p))
+}
@@ -0,0 +1,66 @@
+import java.io.FileOutputStream;
+import java.nio.file.Files;
+import java.nio.file.Paths;
+import java.util.Arrays;
+
+import org.apache.datasketches.memory.Memory;
+import org.apache.datasketches.req.ReqSketch;
+
+/**
+ * Generates the REQ sketch fixtures read by
+ * TestREQSketch_UnmarshalDataSketchesJava, and checks that the golden files
+ * written by the Go encoder in the parent directory are decoded by
+ * datasketches-java and encoded back in the same bytes. Run it in this
+ * directory with datasketches-java and datasketches-memory on the classpath:
+ *
+ *   javac -cp $CP GenerateReqFixtures.java
+ *   java -cp $CP:. GenerateReqFixtures
+ *
+ * The items are a permutation of 1..n so that the test can compute the
+ * expected results without the sketch.
+ */
+public class GenerateReqFixtures {
+  public static void main(String[] args) throws Exception {
+    final int[] ns = {0, 3, 50, 1000};
+    final String[] formats = {"empty", "raw", "exact", "estimation"};
+    for (final boolean hra : new boolean[] {false, true}) {
+      for (int i = 0; i < ns.length; i++) {
+        final ReqSketch sk = ReqSketch.builder().setK(12).setHighRankAccuracy(hra).build();
+        final int n = ns[i];
+        for (int j = 0; j < n; j++) {
+          sk.update(item(j, n));
+        }
+        final String name = String.format("req_k12_%s_%s_java.sk", hra ? "hra" : "lra", formats[i]);
+        try (FileOutputStream out = new FileOutputStream(name)) {
+          out.write(sk.toByteArray());
+        }
+      }
+    }
+
+    // Raw items are decoded by adding them one by one, which reverses their
+    // order in a high rank accuracy buffer, so req_k12_hra_raw.bin is only
+    // checked for its count.
+    final String[] goNames = {
+      "req_k12_lra_empty.bin", "req_k12_hra_raw.bin",
+      "req_k12_lra_exact.bin", "req_k12_hra_exact.bin",
+      "req_k12_lra_estimation.bin", "req_k12_hra_estimation.bin",
+      "req_k14_hra_estimation.bin",
+    };
+    final long[] goNs = {0, 3, 50, 50, 1000, 1000, 10000};
+    for (int i = 0; i < goNames.length; i++) {
+      final byte[] data = Files.readAllBytes(Paths.get("..", goNames[i]));
+      final ReqSketch sk = ReqSketch.heapify(Memory.wrap(data));
+      if (sk.getN() != goNs[i]) {
+        throw new AssertionError(goNames[i] + ": N mismatch, got=" + sk.getN() + ", want=" + goNs[i]);
+      }
+      if (!goNames[i].contains("_raw") && !Arrays.equals(sk.toByteArray(), data)) {
+        throw new AssertionError(goNames[i] + ": bytes mismatch after round trip");
+      }
+    }
+  }
+
+  // item returns the j-th item of a permutation of 1..n.
+  static float item(final int j, final int n) {
+    return (float) ((long) j * 7919 % n + 1);
+  }
+}
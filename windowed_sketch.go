@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/exp/constraints"
+)
+
+// Clock provides the current time. It can be replaced in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// TimedSketchOption configures a sketch whose content depends on the
+// time of adding items.
+type TimedSketchOption func(*timedSketchConfig)
+
+type timedSketchConfig struct {
+	clock   Clock
+	reqOpts []REQSketchOption
+}
+
+func newTimedSketchConfig(opts []TimedSketchOption) timedSketchConfig {
+	cfg := timedSketchConfig{clock: systemClock{}}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithClock makes the sketch get the current time from clock instead of
+// the system clock.
+func WithClock(clock Clock) TimedSketchOption {
+	return func(c *timedSketchConfig) {
+		c.clock = clock
+	}
+}
+
+// WithREQSketchOptions makes the sketch create the underlying REQSketch
+// with opts.
+func WithREQSketchOptions(opts ...REQSketchOption) TimedSketchOption {
+	return func(c *timedSketchConfig) {
+		c.reqOpts = append(c.reqOpts, opts...)
+	}
+}
+
+// WindowedSketch answers quantile queries over the items added in a
+// sliding time window. It keeps a ring of REQSketch, one per sub-interval
+// of granularity, and rotates them as time advances. Queries are answered
+// by a merged view of the live sub-intervals, which is cached until the
+// next rotation.
+//
+// Since items are expired per sub-interval, the items added in the last
+// window-granularity to window are covered, depending on the current time
+// in the newest sub-interval.
+type WindowedSketch[T constraints.Ordered] struct {
+	k       int
+	hra     bool
+	reqOpts []REQSketchOption
+	// seed from which the seed of each sketch is derived
+	seed int64
+
+	granularity time.Duration
+	clock       Clock
+
+	// buckets is a ring of sketches and buckets[head] is the newest one,
+	// which covers [headStart, headStart+granularity). A bucket is nil
+	// until an item is added to its sub-interval.
+	buckets   []*REQSketch[T]
+	head      int
+	headStart time.Time
+
+	// merged view of all buckets, nil until the first query after
+	// rotation
+	merged *REQSketch[T]
+}
+
+const (
+	// windowedMaxBuckets is the maximum number of sub-intervals in a
+	// window.
+	windowedMaxBuckets = 1 << 16
+	// windowedSeedIncrement is multiplied by the bucket index to derive
+	// the seed of each sketch. It must differ from the golden ratio
+	// increment of REQSketch.newCompactorRandom, so that the compactors
+	// of different sketches do not make the same coin flips.
+	windowedSeedIncrement = 0x94d049bb133111eb
+)
+
+// ErrInvalidWindow is returned when the window of WindowedSketch is not a
+// positive multiple of the granularity, or is more than 65536 times the
+// granularity.
+var ErrInvalidWindow = errors.New("window must be a positive multiple of positive granularity up to 65536 times")
+
+// NewWindowedSketch creates a WindowedSketch. It panics if window,
+// granularity or k is invalid.
+// @param window the length of the sliding window.
+// @param granularity the length of a sub-interval, by which the window
+// slides.
+// @param k and highRankAccuracy are the same as NewREQSketch.
+// @param opts WithREQSketchOptions applies to the sketches of sub-intervals
+// and merged views. Each of them is seeded with a distinct seed derived
+// from the seed given by WithSeed.
+func NewWindowedSketch[T constraints.Ordered](window, granularity time.Duration, k int, highRankAccuracy bool, opts ...TimedSketchOption) *WindowedSketch[T] {
+	s, err := NewWindowedSketchE[T](window, granularity, k, highRankAccuracy, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// NewWindowedSketchE creates a WindowedSketch. It returns ErrInvalidWindow
+// if window is not a positive multiple of granularity or has more than
+// 65536 sub-intervals, ErrInvalidK if k is invalid, or ErrLessTypeMismatch
+// if the item type of WithLess given by WithREQSketchOptions does not
+// match T.
+func NewWindowedSketchE[T constraints.Ordered](window, granularity time.Duration, k int, highRankAccuracy bool, opts ...TimedSketchOption) (*WindowedSketch[T], error) {
+	if granularity <= 0 || window <= 0 || window%granularity != 0 || window/granularity > windowedMaxBuckets {
+		return nil, ErrInvalidWindow
+	}
+	if err := checkK(k); err != nil {
+		return nil, err
+	}
+	cfg := newTimedSketchConfig(opts)
+	s := &WindowedSketch[T]{
+		k:           k,
+		hra:         highRankAccuracy,
+		reqOpts:     cfg.reqOpts,
+		granularity: granularity,
+		clock:       cfg.clock,
+		buckets:     make([]*REQSketch[T], window/granularity),
+		headStart:   cfg.clock.Now().Truncate(granularity),
+	}
+	// This validates the options and gets the seed, which is taken from
+	// the current time unless given.
+	b, err := newREQSketchWithOptions[T](k, highRankAccuracy, NaNPolicyPanic, cfg.reqOpts)
+	if err != nil {
+		return nil, err
+	}
+	s.seed = b.Seed()
+	// Only the current sub-interval is allocated here.
+	s.buckets[s.head] = s.newREQSketch(s.head)
+	return s, nil
+}
+
+// newREQSketch creates the sketch for the bucket at index i, or the merged
+// view if i is -1.
+func (s *WindowedSketch[T]) newREQSketch(i int) *REQSketch[T] {
+	opts := append(s.reqOpts[:len(s.reqOpts):len(s.reqOpts)], withDerivedSeed(windowedSketchSeed(s.seed, i)))
+	return NewREQSketch[T](s.k, s.hra, opts...)
+}
+
+// windowedSketchSeed returns the seed for the bucket at index i, or the
+// merged view if i is -1.
+func windowedSketchSeed(seed int64, i int) int64 {
+	return int64(uint64(seed) + uint64(i+1)*windowedSeedIncrement)
+}
+
+// Add adds item to the current sub-interval. It panics if item is NaN
+// unless the NaN policy given by WithREQSketchOptions is NaNPolicySkip.
+func (s *WindowedSketch[T]) Add(item T) {
+	if err := s.TryAdd(item); err != nil {
+		panic(err)
+	}
+}
+
+// TryAdd adds item to the current sub-interval. NaN is handled in the same
+// way as REQSketch.TryAdd.
+func (s *WindowedSketch[T]) TryAdd(item T) error {
+	s.rotate()
+	if s.buckets[s.head] == nil {
+		s.buckets[s.head] = s.newREQSketch(s.head)
+	}
+	if err := s.buckets[s.head].TryAdd(item); err != nil {
+		return err
+	}
+	// The merged view stays valid with the new item, so that it needs
+	// to be rebuilt only on rotation.
+	if s.merged != nil {
+		return s.merged.TryAdd(item)
+	}
+	return nil
+}
+
+// Quantile returns the approximate item at the normalized rank over the
+// window with the same semantics as REQSketch.Quantile.
+func (s *WindowedSketch[T]) Quantile(normRank float64, searchCrit QuantileSearchCriteria) (T, error) {
+	return s.view().Quantile(normRank, searchCrit)
+}
+
+// Quantiles returns the approximate items at normRanks over the window
+// with the same semantics as REQSketch.Quantiles.
+func (s *WindowedSketch[T]) Quantiles(normRanks []float64, searchCrit QuantileSearchCriteria) ([]T, error) {
+	return s.view().Quantiles(normRanks, searchCrit)
+}
+
+// Rank returns the approximate normalized rank of item over the window
+// with the same semantics as REQSketch.Rank.
+func (s *WindowedSketch[T]) Rank(item T, searchCrit QuantileSearchCriteria) (float64, error) {
+	return s.view().Rank(item, searchCrit)
+}
+
+// N returns the number of items in the window.
+func (s *WindowedSketch[T]) N() int {
+	s.rotate()
+	n := 0
+	for _, b := range s.buckets {
+		if b != nil {
+			n += b.N()
+		}
+	}
+	return n
+}
+
+// Reset removes all items and releases the sketches of sub-intervals.
+func (s *WindowedSketch[T]) Reset() {
+	for i := range s.buckets {
+		s.buckets[i] = nil
+	}
+	s.head = 0
+	s.headStart = s.clock.Now().Truncate(s.granularity)
+	s.merged = nil
+}
+
+// rotate advances the ring to the current time. The sketches of the
+// sub-intervals which went out of the window are released. If the clock
+// goes backwards, the current sub-interval is kept.
+func (s *WindowedSketch[T]) rotate() {
+	steps := int64(s.clock.Now().Sub(s.headStart) / s.granularity)
+	if steps <= 0 {
+		return
+	}
+	s.headStart = s.headStart.Add(time.Duration(steps) * s.granularity)
+	if steps > int64(len(s.buckets)) {
+		steps = int64(len(s.buckets))
+	}
+	for i := int64(0); i < steps; i++ {
+		s.head = (s.head + 1) % len(s.buckets)
+		s.buckets[s.head] = nil
+	}
+	s.merged = nil
+}
+
+// view returns the merged view of the window after rotation.
+func (s *WindowedSketch[T]) view() *REQSketch[T] {
+	s.rotate()
+	if s.merged != nil {
+		return s.merged
+	}
+	merged := s.newREQSketch(-1)
+	for i := 1; i <= len(s.buckets); i++ {
+		// from the oldest to the newest
+		b := s.buckets[(s.head+i)%len(s.buckets)]
+		if b == nil || b.IsEmpty() {
+			continue
+		}
+		if err := merged.Merge(b); err != nil {
+			// all sketches have the same high rank accuracy setting.
+			panic(err)
+		}
+	}
+	s.merged = merged
+	return merged
+}
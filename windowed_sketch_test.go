@@ -0,0 +1,256 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"pgregory.net/rapid"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func TestNewWindowedSketchE(t *testing.T) {
+	testCases := []struct {
+		window      time.Duration
+		granularity time.Duration
+		k           int
+		want        error
+	}{
+		{window: 5 * time.Minute, granularity: 10 * time.Second, k: 12, want: nil},
+		{window: 5 * time.Minute, granularity: 7 * time.Second, k: 12, want: ErrInvalidWindow},
+		{window: 0, granularity: time.Second, k: 12, want: ErrInvalidWindow},
+		{window: time.Minute, granularity: 0, k: 12, want: ErrInvalidWindow},
+		{window: windowedMaxBuckets * time.Second, granularity: time.Second, k: 12, want: nil},
+		{window: (windowedMaxBuckets + 1) * time.Second, granularity: time.Second, k: 12, want: ErrInvalidWindow},
+		{window: time.Hour, granularity: time.Nanosecond, k: 12, want: ErrInvalidWindow},
+		{window: time.Minute, granularity: time.Second, k: 3, want: ErrInvalidK},
+	}
+	for i, tc := range testCases {
+		if _, err := NewWindowedSketchE[float64](tc.window, tc.granularity, tc.k, true); err != tc.want {
+			t.Errorf("error mismatch, case=%d, got=%v, want=%v", i, err, tc.want)
+		}
+	}
+	less := WithLess(func(a, b int) bool { return a < b })
+	if _, err := NewWindowedSketchE[float64](time.Minute, time.Second, 12, true, WithREQSketchOptions(less)); err != ErrLessTypeMismatch {
+		t.Errorf("error mismatch, got=%v, want=%v", err, ErrLessTypeMismatch)
+	}
+}
+
+func TestWindowedSketch_Seed(t *testing.T) {
+	clock := newFakeClock()
+	s := NewWindowedSketch[float64](time.Minute, time.Second, 12, true,
+		WithClock(clock), WithREQSketchOptions(WithSeed(42)))
+	for i := 0; i < 3; i++ {
+		s.Add(float64(i))
+		clock.Advance(time.Second)
+	}
+	seeds := map[int64]bool{s.view().Seed(): true}
+	for _, b := range s.buckets {
+		if b != nil {
+			seeds[b.Seed()] = true
+		}
+	}
+	if got, want := len(seeds), 4; got != want {
+		t.Errorf("number of distinct seeds mismatch, got=%d, want=%d", got, want)
+	}
+
+	// The compactors of all sketches must have distinct seeds.
+	const golden = 0x9e3779b97f4a7c15
+	for _, seed := range []int64{0, 1, 42, -1, math.MaxInt64} {
+		compactorSeeds := make(map[int64]bool)
+		for i := -1; i < 1000; i++ {
+			for lgWeight := 0; lgWeight < 64; lgWeight++ {
+				compactorSeed := int64(uint64(windowedSketchSeed(seed, i)) + uint64(lgWeight)*golden)
+				if compactorSeeds[compactorSeed] {
+					t.Fatalf("duplicate compactor seed, seed=%d, i=%d, lgWeight=%d", seed, i, lgWeight)
+				}
+				compactorSeeds[compactorSeed] = true
+			}
+		}
+	}
+}
+
+func TestWindowedSketch_LazyBuckets(t *testing.T) {
+	clock := newFakeClock()
+	s := NewWindowedSketch[float64](windowedMaxBuckets*time.Second, time.Second, 12, true, WithClock(clock))
+	numAllocated := func() int {
+		n := 0
+		for _, b := range s.buckets {
+			if b != nil {
+				n++
+			}
+		}
+		return n
+	}
+	if got, want := numAllocated(), 1; got != want {
+		t.Errorf("allocated buckets mismatch after creation, got=%d, want=%d", got, want)
+	}
+	for i := 0; i < 3; i++ {
+		s.Add(float64(i))
+		clock.Advance(10 * time.Second)
+	}
+	if got, want := numAllocated(), 3; got != want {
+		t.Errorf("allocated buckets mismatch after adds, got=%d, want=%d", got, want)
+	}
+	if got, err := s.Quantile(1, QuantileSearchCriteriaInclusive); err != nil || got != 2 {
+		t.Errorf("quantile mismatch, got=%g, err=%v, want=2", got, err)
+	}
+
+	clock.Advance(windowedMaxBuckets * time.Second)
+	if got, want := s.N(), 0; got != want {
+		t.Errorf("count mismatch after expiration, got=%d, want=%d", got, want)
+	}
+	if got, want := numAllocated(), 0; got != want {
+		t.Errorf("allocated buckets mismatch after expiration, got=%d, want=%d", got, want)
+	}
+	s.Add(5)
+	s.Reset()
+	if got, want := numAllocated(), 0; got != want {
+		t.Errorf("allocated buckets mismatch after reset, got=%d, want=%d", got, want)
+	}
+}
+
+func TestWindowedSketch_Expire(t *testing.T) {
+	clock := newFakeClock()
+	s := NewWindowedSketch[float64](3*time.Second, time.Second, 12, true, WithClock(clock))
+	if _, err := s.Quantile(0.5, QuantileSearchCriteriaInclusive); err != errEmptySketch {
+		t.Errorf("error mismatch, got=%v, want=%v", err, errEmptySketch)
+	}
+
+	// one item per second: 1 at 0s, 2 at 1s, ...
+	for i := 1; i <= 5; i++ {
+		s.Add(float64(i))
+		if i < 5 {
+			clock.Advance(time.Second)
+		}
+	}
+	if got, want := s.N(), 3; got != want {
+		t.Errorf("n mismatch, got=%d, want=%d", got, want)
+	}
+	if got, err := s.Quantile(0, QuantileSearchCriteriaInclusive); err != nil || got != 3 {
+		t.Errorf("min quantile mismatch, got=%g, err=%v, want=3", got, err)
+	}
+	if got, err := s.Rank(4, QuantileSearchCriteriaInclusive); err != nil || got != 2.0/3 {
+		t.Errorf("rank mismatch, got=%g, err=%v, want=%g", got, err, 2.0/3)
+	}
+
+	// a jump longer than the window expires all items
+	clock.Advance(time.Hour)
+	if got, want := s.N(), 0; got != want {
+		t.Errorf("n mismatch after jump, got=%d, want=%d", got, want)
+	}
+	s.Add(10)
+	if got, err := s.Quantile(0.5, QuantileSearchCriteriaInclusive); err != nil || got != 10 {
+		t.Errorf("quantile mismatch after jump, got=%g, err=%v, want=10", got, err)
+	}
+}
+
+func TestWindowedSketch_CachedView(t *testing.T) {
+	clock := newFakeClock()
+	s := NewWindowedSketch[float64](time.Minute, time.Second, 12, true, WithClock(clock))
+	s.Add(1)
+	v := s.view()
+	if s.view() != v {
+		t.Errorf("merged view must be cached")
+	}
+
+	// adding an item keeps the cached view up to date
+	s.Add(2)
+	if s.view() != v {
+		t.Errorf("merged view must be kept after add")
+	}
+	if got, want := v.N(), 2; got != want {
+		t.Errorf("merged view n mismatch, got=%d, want=%d", got, want)
+	}
+
+	clock.Advance(time.Second)
+	if s.view() == v {
+		t.Errorf("merged view must be rebuilt after rotation")
+	}
+	if got, want := s.view().N(), 2; got != want {
+		t.Errorf("merged view n mismatch after rotation, got=%d, want=%d", got, want)
+	}
+
+	s.Reset()
+	if got, want := s.N(), 0; got != want {
+		t.Errorf("n mismatch after reset, got=%d, want=%d", got, want)
+	}
+}
+
+func TestWindowedSketch_PropertyCompareToNaive(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		seed := rapid.Int64().Draw(t, "seed")
+		hra := rapid.Bool().Draw(t, "hra")
+		numBuckets := rapid.IntRange(1, 10).Draw(t, "numBuckets")
+		const k = 12
+		const granularity = time.Second
+		clock := newFakeClock()
+		s := NewWindowedSketch[float64](time.Duration(numBuckets)*granularity, granularity, k, hra,
+			WithClock(clock), WithREQSketchOptions(WithSeed(seed)))
+		rnd := rand.New(rand.NewSource(seed))
+
+		type timedValue struct {
+			bucket int64
+			v      float64
+		}
+		var values []timedValue
+		numSteps := 1 + rnd.Intn(30)
+		for i := 0; i < numSteps; i++ {
+			clock.Advance(time.Duration(rnd.Int63n(int64(2 * granularity))))
+			bucket := clock.Now().UnixNano() / int64(granularity)
+			n := rnd.Intn(500)
+			for j := 0; j < n; j++ {
+				v := rnd.Float64()
+				s.Add(v)
+				values = append(values, timedValue{bucket: bucket, v: v})
+			}
+			// query sometimes so that the cached view is exercised
+			if rnd.Intn(2) == 0 {
+				_, _ = s.Quantile(0.5, QuantileSearchCriteriaInclusive)
+			}
+		}
+
+		sRef := &SummaryNaiveImpl{}
+		current := clock.Now().UnixNano() / int64(granularity)
+		for _, tv := range values {
+			if tv.bucket > current-int64(numBuckets) {
+				sRef.Add(tv.v)
+			}
+		}
+		n := len(sRef.values)
+		if got, want := s.N(), n; got != want {
+			t.Fatalf("n mismatch, got=%d, want=%d", got, want)
+		}
+		if n == 0 {
+			return
+		}
+		checkValid(t, s.view())
+
+		pValues := []float64{0, 0.25, 0.5, 0.75, 0.99, 0.999, 1}
+		for _, p := range pValues {
+			v, err := s.Quantile(p, QuantileSearchCriteriaInclusive)
+			if err != nil {
+				t.Fatalf("quantile: p=%g, err=%s", p, err)
+			}
+			gotRank := sRef.Rank(v)
+			wantRank := int(math.Ceil(p * float64(n)))
+			margin := int(math.Ceil(reqRelativeRankErrorBound(k, hra, p)*float64(n))) + 1
+			if gotRank < wantRank-margin || gotRank > wantRank+margin {
+				t.Fatalf("quantile rank out of range, p=%g, v=%g, gotRank=%d, wantRank=%d, margin=%d",
+					p, v, gotRank, wantRank, margin)
+			}
+		}
+	})
+}